@@ -1,129 +1,972 @@
 package gateway
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/moleculer-go/moleculer"
+	molcontext "github.com/moleculer-go/moleculer/context"
 	"github.com/moleculer-go/moleculer/payload"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 type actionHandler struct {
+	routeName            string
 	routePath            string
 	alias                string
 	action               string
+	route                map[string]interface{}
+	settings             map[string]interface{}
 	context              moleculer.Context
 	acceptedMethodsCache map[string]bool
+	// callSlots is the semaphore shared by the handlers of the service, limiting the in-flight
+	// action calls to the maxConcurrent setting. nil means no limit.
+	callSlots chan bool
+	// cache keeps the GET responses when the route has the cache setting, nil otherwise.
+	cache *responseCache
+	// pathMapper translate the action name into the path of actions without alias, nil uses the default.
+	pathMapper func(string) string
+}
+
+type routeNameKey struct{}
+
+// RouteName return the name of the route that matched the request.
+// Useful inside hooks like onBeforeCall to know which route is handling the request.
+func RouteName(request *http.Request) string {
+	name, _ := request.Context().Value(routeNameKey{}).(string)
+	return name
+}
+
+// streamMethods are the alias methods of the stream aliases: SSE for Server-Sent Events and WS for WebSockets.
+var streamMethods = map[string]bool{"SSE": true, "WS": true}
+
+// validateAlias check the alias format: [METHOD] path [successCode] e.g. "POST users 201" or "GET|POST users".
+// the method can also be SSE for Server-Sent Events, e.g. "SSE notifications", or WS for WebSockets, e.g. "WS chat".
+func validateAlias(alias string) error {
+	parts := strings.Split(strings.TrimSpace(alias), " ")
+	if len(parts) > 3 {
+		return fmt.Errorf("Invalid alias format: %q - expected [METHOD] path [successCode]", alias)
+	}
+	if len(parts) == 1 {
+		return nil
+	}
+	if _, valid := aliasMethods(parts[0]); !valid && !streamMethods[strings.ToUpper(parts[0])] {
+		return fmt.Errorf("Invalid alias method: %q in alias: %q", parts[0], alias)
+	}
+	if len(parts) == 3 {
+		if code, err := strconv.Atoi(parts[2]); err != nil || code < 200 || code > 299 {
+			return fmt.Errorf("Invalid alias success code: %q in alias: %q", parts[2], alias)
+		}
+	}
+	return nil
 }
 
 // aliasPath return the alias path, if one exists for the action.
+// the alias is validated by validateAlias when the handlers are created.
 func (handler *actionHandler) aliasPath() string {
-	if handler.alias != "" {
-		parts := strings.Split(strings.TrimSpace(handler.alias), " ")
-		alias := ""
-		if len(parts) == 1 {
-			alias = parts[0]
-		} else if len(parts) == 2 {
-			alias = parts[1]
-		} else {
-			panic(fmt.Sprint("Invalid alias format! -> ", handler.alias))
+	if handler.alias == "" {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(handler.alias), " ")
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	return parts[1]
+}
+
+// muxPathParams translate path params in the format :param into the mux format {param}.
+// params can be constrained with a regex in parenthesis, :id(\d+) becomes {id:\d+}.
+func muxPathParams(path string) string {
+	segments := strings.Split(path, "/")
+	for index, segment := range segments {
+		if !strings.HasPrefix(segment, ":") || len(segment) < 2 {
+			continue
+		}
+		param := segment[1:]
+		open := strings.Index(param, "(")
+		if open > 0 && strings.HasSuffix(param, ")") {
+			param = param[:open] + ":" + param[open+1:len(param)-1]
 		}
-		return alias
+		segments[index] = "{" + param + "}"
 	}
-	return ""
+	return strings.Join(segments, "/")
 }
 
 // pattern return the path pattern used to map URL in the http.ServeMux
 func (handler *actionHandler) pattern() string {
-	actionPath := strings.Replace(handler.action, ".", "/", -1)
+	actionPath := handler.actionPath()
 	fullPath := ""
 	aliasPath := handler.aliasPath()
 	if aliasPath != "" {
-		fullPath = fmt.Sprint(handler.routePath, "/", aliasPath)
+		fullPath = fmt.Sprint(handler.routePath, "/", muxPathParams(aliasPath))
 	} else {
 		fullPath = fmt.Sprint(handler.routePath, "/", actionPath)
 	}
 	return strings.Replace(fullPath, "//", "/", -1)
 }
 
-// invalidHttpMethodError send an error in the reponse about the http method being invalid.
-func (handler *actionHandler) invalidHttpMethodError(logger *log.Entry, response http.ResponseWriter, methods map[string]bool) {
-	acceptedMethods := []string{}
-	for methodName := range methods {
-		acceptedMethods = append(acceptedMethods, methodName)
+// actionPath return the path of the action without alias, from the pathMapper when present,
+// by default the dots of the action name become slashes (users.list -> users/list).
+func (handler *actionHandler) actionPath() string {
+	if handler.pathMapper != nil {
+		return handler.pathMapper(handler.action)
+	}
+	return strings.Replace(handler.action, ".", "/", -1)
+}
+
+// invalidHttpMethodError send a 405 Method Not Allowed with the Allow header listing the accepted methods.
+func (handler *actionHandler) invalidHttpMethodError(logger *log.Entry, request *http.Request, response http.ResponseWriter, methods map[string]bool) {
+	allowed := allowHeader(methods)
+	response.Header().Set("Allow", allowed)
+	error := fmt.Errorf("Invalid HTTP Method - accepted methods: %s", allowed)
+	handler.sendReponse(logger, request, payload.New(statusError{error.Error(), http.StatusMethodNotAllowed}), response)
+}
+
+// allowHeader return the value for the Allow header listing the accepted methods.
+func allowHeader(methods map[string]bool) string {
+	allowed := []string{}
+	for methodName, accepted := range methods {
+		if accepted {
+			allowed = append(allowed, methodName)
+		}
+	}
+	if methods["GET"] {
+		allowed = append(allowed, "HEAD")
+	}
+	sort.Strings(allowed)
+	return strings.Join(allowed, ", ")
+}
+
+// headResponseWriter discards the body and sets the Content-Length the body would have,
+// so HEAD requests get the same headers and status as GET.
+type headResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	length     int
+}
+
+func (w *headResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *headResponseWriter) Write(bytes []byte) (int, error) {
+	w.length += len(bytes)
+	return len(bytes), nil
+}
+
+// finish write the headers with the Content-Length of the discarded body.
+func (w *headResponseWriter) finish() {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
 	}
-	error := fmt.Errorf("Invalid HTTP Method - accepted methods: %s", acceptedMethods)
-	handler.sendReponse(logger, payload.New(error), response)
+	w.Header().Set("Content-Length", strconv.Itoa(w.length))
+	w.ResponseWriter.WriteHeader(w.statusCode)
+}
+
+// sendOptions answer a preflight OPTIONS request with the accepted methods, without invoking the action.
+func (handler *actionHandler) sendOptions(response http.ResponseWriter, methods map[string]bool) {
+	response.Header().Set("Allow", allowHeader(methods))
+	response.WriteHeader(http.StatusNoContent)
 }
 
 var succesStatusCode = 200
 var errorStatusCode = 500
 var resultParseErrorStatusCode = 500
 
+// clientClosedStatusCode is sent (nginx style) when the client disconnects before the action responds.
+var clientClosedStatusCode = 499
+
+// codedError is implemented by errors that carry a numeric status code.
+type codedError interface {
+	Code() int
+}
+
+// statusError is an error with the HTTP status code that should be sent to the client.
+type statusError struct {
+	message string
+	code    int
+}
+
+func (e statusError) Error() string {
+	return e.message
+}
+
+func (e statusError) Code() int {
+	return e.code
+}
+
+// statusCodeFromError return the code carried by the payload error when it is a valid
+// HTTP error status (400-599), otherwise the default error status code.
+func statusCodeFromError(result moleculer.Payload) int {
+	if coded, ok := result.Error().(codedError); ok {
+		code := coded.Code()
+		if code >= 400 && code <= 599 {
+			return code
+		}
+	}
+	return errorStatusCode
+}
+
+// successCode return the status code for successful responses. The status from the alias
+// (e.g. "POST users 201") takes precedence over the route "successCode" setting.
+func (handler *actionHandler) successCode() int {
+	parts := strings.Split(strings.TrimSpace(handler.alias), " ")
+	if len(parts) == 3 {
+		code, err := strconv.Atoi(parts[2])
+		if err == nil && code >= 200 && code <= 299 {
+			return code
+		}
+	}
+	if code, exists := handler.route["successCode"].(int); exists {
+		return code
+	}
+	return succesStatusCode
+}
+
+// sendRaw write the string or bytes result as is, with the route contentType (text/plain by default),
+// for actions that return a formed body like HTML or CSV.
+func (handler *actionHandler) sendRaw(logger *log.Entry, result moleculer.Payload, response http.ResponseWriter) {
+	if contentType, exists := handler.route["contentType"].(string); exists {
+		response.Header().Set("Content-Type", contentType)
+	} else if response.Header().Get("Content-Type") == "" {
+		response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	var body []byte
+	switch value := result.Value().(type) {
+	case []byte:
+		body = value
+	case string:
+		body = []byte(value)
+	default:
+		body = []byte(fmt.Sprint(value))
+	}
+	response.WriteHeader(handler.successCode())
+	logger.Debug("Gateway sendRaw() - action: ", handler.action, " bytes: ", len(body))
+	response.Write(body)
+}
+
+var streamChunkSize = 32 * 1024
+
+// streamResponse copy the reader to the response in chunks, flushing after each chunk.
+func (handler *actionHandler) streamResponse(logger *log.Entry, reader io.Reader, response http.ResponseWriter) {
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if response.Header().Get("Content-Type") == "" {
+		response.Header().Set("Content-Type", "application/octet-stream")
+	}
+	response.WriteHeader(handler.successCode())
+	flusher, canFlush := response.(http.Flusher)
+	buffer := make([]byte, streamChunkSize)
+	total := 0
+	for {
+		read, err := reader.Read(buffer)
+		if read > 0 {
+			if _, writeErr := response.Write(buffer[:read]); writeErr != nil {
+				logger.Error("Gateway streamResponse() - action: ", handler.action, " error writing stream: ", writeErr)
+				return
+			}
+			total += read
+			if canFlush {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Error("Gateway streamResponse() - action: ", handler.action, " error reading stream: ", err)
+			return
+		}
+	}
+	logger.Debug("Gateway streamResponse() - action: ", handler.action, " bytes streamed: ", total)
+}
+
+// aliasMethodIs check if the alias method is the given method, e.g. SSE for "SSE notifications".
+func (handler *actionHandler) aliasMethodIs(method string) bool {
+	parts := strings.Split(strings.TrimSpace(handler.alias), " ")
+	return len(parts) >= 2 && strings.ToUpper(parts[0]) == method
+}
+
+// isSSE check if the alias is a Server-Sent Events alias, e.g. "SSE notifications".
+func (handler *actionHandler) isSSE() bool {
+	return handler.aliasMethodIs("SSE")
+}
+
+// isWS check if the alias is a WebSocket alias, e.g. "WS chat".
+func (handler *actionHandler) isWS() bool {
+	return handler.aliasMethodIs("WS")
+}
+
+// resultStream return the stream of payloads returned by the action, a chan moleculer.Payload.
+func resultStream(result moleculer.Payload) (<-chan moleculer.Payload, bool) {
+	switch value := result.Value().(type) {
+	case chan moleculer.Payload:
+		return value, true
+	case <-chan moleculer.Payload:
+		return value, true
+	}
+	return nil, false
+}
+
+var wsUpgrader = websocket.Upgrader{}
+
+// bridgeWebSocket upgrade the connection and bridge it with the action: the client messages are sent
+// to the "messages" stream in the action params and the payloads of the stream returned by the action
+// are sent to the client, as JSON. the connection is closed when the action stream is closed and the
+// messages stream is closed when the client leaves.
+func (handler *actionHandler) bridgeWebSocket(logger *log.Entry, request *http.Request, response http.ResponseWriter, result moleculer.Payload, messages chan moleculer.Payload) {
+	stream, isStream := resultStream(result)
+	if result.IsError() || !isStream {
+		close(messages)
+		if !result.IsError() {
+			result = payload.New(statusError{"WS action: " + handler.action + " must return a chan moleculer.Payload", http.StatusInternalServerError})
+		}
+		handler.sendReponse(logger, request, result, response)
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(response, request, nil)
+	if err != nil {
+		close(messages)
+		logger.Debug("Gateway bridgeWebSocket() - action: ", handler.action, " upgrade failed - error: ", err)
+		return
+	}
+	defer conn.Close()
+	serializer := settingsSerializer(handler.settings)
+	done := make(chan bool)
+	defer close(done)
+	clientLeft := make(chan bool)
+	go func() {
+		defer close(messages)
+		defer close(clientLeft)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			message := payload.New(string(data))
+			if gjson.ValidBytes(data) {
+				message = serializer.BytesToPayload(&data)
+			}
+			select {
+			case messages <- message:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case message, open := <-stream:
+			if !open {
+				logger.Debug("Gateway bridgeWebSocket() - action: ", handler.action, " stream closed")
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if message.IsError() {
+				message = payload.Empty().Add("error", message.Error().Error())
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, serializer.PayloadToBytes(message)); err != nil {
+				logger.Debug("Gateway bridgeWebSocket() - action: ", handler.action, " write failed - error: ", err)
+				return
+			}
+		case <-clientLeft:
+			logger.Debug("Gateway bridgeWebSocket() - action: ", handler.action, " client disconnected")
+			return
+		}
+	}
+}
+
+// streamEvents send the payloads of the stream returned by the action (a chan moleculer.Payload)
+// as Server-Sent Events, one data frame per payload, until the stream is closed or the client leaves.
+// other results are sent as a single event.
+func (handler *actionHandler) streamEvents(logger *log.Entry, request *http.Request, result moleculer.Payload, response http.ResponseWriter) {
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("Connection", "keep-alive")
+	response.WriteHeader(http.StatusOK)
+	flusher, canFlush := response.(http.Flusher)
+	serializer := settingsSerializer(handler.settings)
+	send := func(event moleculer.Payload) {
+		if event.IsError() {
+			fmt.Fprintf(response, "event: error\ndata: %s\n\n", serializer.PayloadToBytes(payload.Empty().Add("error", event.Error().Error())))
+		} else {
+			fmt.Fprintf(response, "data: %s\n\n", serializer.PayloadToBytes(event))
+		}
+		if canFlush {
+			flusher.Flush()
+		}
+	}
+	stream, isStream := resultStream(result)
+	if !isStream {
+		send(result)
+		return
+	}
+	if canFlush {
+		flusher.Flush()
+	}
+	events := 0
+	for {
+		select {
+		case event, open := <-stream:
+			if !open {
+				logger.Debug("Gateway streamEvents() - action: ", handler.action, " stream closed - events: ", events)
+				return
+			}
+			send(event)
+			events++
+		case <-request.Context().Done():
+			logger.Debug("Gateway streamEvents() - action: ", handler.action, " client disconnected - events: ", events)
+			return
+		}
+	}
+}
+
 // sendReponse send the result payload  back using the ResponseWriter
-func (handler *actionHandler) sendReponse(logger *log.Entry, result moleculer.Payload, response http.ResponseWriter) {
-	var json []byte
-	response.Header().Add("Content-Type", "application/json")
+// results with an io.Reader value are streamed instead of serialized.
+// the serializer is selected from the request Accept header (JSON, msgpack or XML).
+func (handler *actionHandler) sendReponse(logger *log.Entry, request *http.Request, result moleculer.Payload, response http.ResponseWriter) {
+	handler.setResponseHeaders(response)
+	if reader, isReader := result.Value().(io.Reader); isReader {
+		handler.streamResponse(logger, reader, response)
+		return
+	}
+	if handler.isSSE() && !result.IsError() {
+		handler.streamEvents(logger, request, result, response)
+		return
+	}
+	if raw, _ := handler.route["raw"].(bool); raw && !result.IsError() {
+		handler.sendRaw(logger, result, response)
+		return
+	}
+	serializer, contentType := serializerForAccept(request.Header.Get("Accept"), handler.settings)
+	var body []byte
+	response.Header().Set("Content-Type", contentType)
 	if result.IsError() {
-		response.WriteHeader(errorStatusCode)
-		json = jsonSerializer.PayloadToBytes(payload.Empty().Add("error", result.Error().Error()))
+		statusCode := statusCodeFromError(result)
+		response.WriteHeader(statusCode)
+		rendered, exists := handler.renderErrorTemplate(logger, serializer, result.Error(), statusCode)
+		if exists {
+			body = rendered
+		} else {
+			body = serializer.PayloadToBytes(handler.errorBody(result.Error(), statusCode))
+		}
 	} else {
-		response.WriteHeader(succesStatusCode)
-		json = jsonSerializer.PayloadToBytes(result)
+		body = serializer.PayloadToBytes(handler.successBody(result))
+		if request.Method == http.MethodGet || request.Method == http.MethodHead {
+			etag := bodyETag(body)
+			response.Header().Set("ETag", etag)
+			if etagMatches(request.Header.Get("If-None-Match"), etag) {
+				logger.Debug("Gateway SendReponse() - action: ", handler.action, " not modified - etag: ", etag)
+				response.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		response.WriteHeader(handler.successCode())
 	}
-	logger.Debug("Gateway SendReponse() - action: ", handler.action, " json: ", string(json), " result.IsError(): ", result.IsError())
-	response.Write(json)
+	logger.Debug("Gateway SendReponse() - action: ", handler.action, " contentType: ", contentType, " bytes: ", len(body), " result.IsError(): ", result.IsError())
+	handler.logResponseData(logger, contentType, body, result)
+	response.Write(body)
 }
 
-func (handler *actionHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
-	methods := handler.acceptedMethods()
-	logger := handler.context.Logger()
-	switch request.Method {
-	case http.MethodGet:
-		if methods["GET"] {
-			handler.sendReponse(logger, <-handler.context.Call(handler.action, paramsFromRequest(request, logger)), response)
+// errorBody return the payload sent for an error: {"error": message, "name", "code"} by default, or the envelope
+// {"error": {"message", "name", "code", "type"}} when the errorEnvelope setting is true.
+// errorEnvelope can also be a func(error, int) interface{} returning a custom envelope.
+func (handler *actionHandler) errorBody(err error, statusCode int) moleculer.Payload {
+	switch envelope := handler.settings["errorEnvelope"].(type) {
+	case bool:
+		if envelope {
+			return payload.Empty().Add("error", map[string]interface{}{
+				"message": err.Error(),
+				"name":    errorName(err),
+				"code":    statusCode,
+				"type":    http.StatusText(statusCode),
+			})
 		}
-	case http.MethodPost:
-		if methods["POST"] {
-			handler.sendReponse(logger, <-handler.context.Call(handler.action, paramsFromRequest(request, logger)), response)
+	case func(error, int) interface{}:
+		return payload.New(envelope(err, statusCode))
+	}
+	return payload.Empty().Add("error", err.Error()).Add("name", errorName(err)).Add("code", statusCode)
+}
+
+// errorTemplateFuncs are the functions available in the errorTemplates, json quote a value
+// e.g. {"message": {{json .Message}}}.
+var errorTemplateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		bts, err := json.Marshal(value)
+		return string(bts), err
+	},
+}
+
+// renderErrorTemplate render the error body with the template for the status code from the errorTemplates
+// setting: a text/template with the Message, Name and Code of the error, or a func(error, int) interface{}
+// returning the value to serialize. returns false when there is no template (or it fails) for the status code.
+func (handler *actionHandler) renderErrorTemplate(logger *log.Entry, serializer payloadSerializer, err error, statusCode int) ([]byte, bool) {
+	templates, _ := handler.settings["errorTemplates"].(map[int]interface{})
+	switch errorTemplate := templates[statusCode].(type) {
+	case func(error, int) interface{}:
+		return serializer.PayloadToBytes(payload.New(errorTemplate(err, statusCode))), true
+	case string:
+		parsed, parseErr := template.New("error").Funcs(errorTemplateFuncs).Parse(errorTemplate)
+		if parseErr != nil {
+			logger.Error("Gateway renderErrorTemplate() - invalid template for status: ", statusCode, " error: ", parseErr)
+			return nil, false
+		}
+		var body bytes.Buffer
+		data := map[string]interface{}{"Message": err.Error(), "Name": errorName(err), "Code": statusCode}
+		if executeErr := parsed.Execute(&body, data); executeErr != nil {
+			logger.Error("Gateway renderErrorTemplate() - error rendering template for status: ", statusCode, " error: ", executeErr)
+			return nil, false
+		}
+		return body.Bytes(), true
+	}
+	return nil, false
+}
+
+// namedError is implemented by errors that carry their type name, e.g. "ValidationError".
+type namedError interface {
+	Name() string
+}
+
+// errorName return the name of the error: the one it carries, the status text of the gateway
+// errors (e.g. "NotFoundError", "InternalServerError") or "MoleculerError" for plain errors.
+func errorName(err error) string {
+	if named, ok := err.(namedError); ok && named.Name() != "" {
+		return named.Name()
+	}
+	if status, ok := err.(statusError); ok && http.StatusText(status.code) != "" {
+		name := strings.Replace(http.StatusText(status.code), " ", "", -1)
+		if strings.HasSuffix(name, "Error") {
+			return name
+		}
+		return name + "Error"
+	}
+	return "MoleculerError"
+}
+
+// successBody return the payload sent for a successful result, wrapped in {"data": result}
+// when the successEnvelope setting is true.
+func (handler *actionHandler) successBody(result moleculer.Payload) moleculer.Payload {
+	if envelope, _ := handler.settings["successEnvelope"].(bool); envelope {
+		return payload.Empty().Add("data", plainValue(result))
+	}
+	return result
+}
+
+// setResponseHeaders set the headers from the route responseHeaders setting, e.g. Cache-Control.
+func (handler *actionHandler) setResponseHeaders(response http.ResponseWriter) {
+	headers, _ := handler.route["responseHeaders"].(map[string]string)
+	for name, value := range headers {
+		response.Header().Set(name, value)
+	}
+}
+
+// bodyETag return a strong ETag computed from the serialized body.
+func bodyETag(body []byte) string {
+	return fmt.Sprintf("\"%x\"", sha1.Sum(body))
+}
+
+// etagMatches check if the If-None-Match header (a list of ETags or *) matches the etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// logResponseData log the response body at the level of the logResponseData setting, nil means off.
+// non JSON bodies (e.g. msgpack) are logged as JSON to keep the logs readable.
+func (handler *actionHandler) logResponseData(logger *log.Entry, contentType string, body []byte, result moleculer.Payload) {
+	level, enabled := logLevelSetting(handler.settings, "logResponseData")
+	if !enabled {
+		return
+	}
+	if contentType != "application/json" {
+		body = jsonSerializer.PayloadToBytes(result)
+	}
+	logger.Log(level, "Gateway sendReponse() - action: ", handler.action, " data: ", string(body))
+}
+
+// authorize invoke the authorize function from settings when the route requires authorization.
+// returns the payload from the authorize function (e.g. user info) or an error when not authorized.
+func (handler *actionHandler) authorize(request *http.Request) (moleculer.Payload, error) {
+	required, _ := handler.route["authorization"].(bool)
+	if !required {
+		return nil, nil
+	}
+	authorize, exists := handler.settings["authorize"].(func(moleculer.Context, map[string]interface{}, *http.Request) (moleculer.Payload, error))
+	if !exists {
+		return nil, errors.New("Authorization is required but no authorize function was configured")
+	}
+	return authorize(handler.context, handler.route, request)
+}
+
+var requestIDHeader = "X-Request-ID"
+
+// requestIDFromRequest return the X-Request-ID header from the request or a new UUID when absent.
+func requestIDFromRequest(request *http.Request) string {
+	if requestID := strings.TrimSpace(request.Header.Get(requestIDHeader)); requestID != "" {
+		return requestID
+	}
+	return newRequestID()
+}
+
+// newRequestID generate a random (version 4) UUID.
+func newRequestID() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	bytes[6] = (bytes[6] & 0x0f) | 0x40
+	bytes[8] = (bytes[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", bytes[0:4], bytes[4:6], bytes[6:8], bytes[8:10], bytes[10:])
+}
+
+// params extract the action params from the request, with the route paramMapper when present.
+func (handler *actionHandler) params(logger *log.Entry, request *http.Request) moleculer.Payload {
+	if paramMapper, exists := handler.route["paramMapper"].(func(*http.Request) moleculer.Payload); exists {
+		return paramMapper(request)
+	}
+	return paramsFromRequestOrdered(request, handler.settings, paramPrecedence(handler.route, handler.settings), stringsSetting(handler.route, "alwaysArray"), logger)
+}
+
+// passHeaders return the request headers listed in the route or service passHeaders setting,
+// sent to the action as meta "headers".
+func (handler *actionHandler) passHeaders(request *http.Request) map[string]interface{} {
+	names := stringsSetting(handler.route, "passHeaders")
+	if names == nil {
+		names = stringsSetting(handler.settings, "passHeaders")
+	}
+	headers := map[string]interface{}{}
+	for _, name := range names {
+		if value := request.Header.Get(name); value != "" {
+			headers[name] = value
+		}
+	}
+	return headers
+}
+
+// logHeaders log the request headers listed in the route logHeaders setting, other headers are
+// left out so secrets (e.g. Authorization, Cookie) don't end up in the logs.
+func (handler *actionHandler) logHeaders(logger *log.Entry, request *http.Request) {
+	names := stringsSetting(handler.route, "logHeaders")
+	if len(names) == 0 {
+		return
+	}
+	headers := log.Fields{}
+	for _, name := range names {
+		if values, exists := request.Header[http.CanonicalHeaderKey(name)]; exists {
+			headers[http.CanonicalHeaderKey(name)] = strings.Join(values, ", ")
+		}
+	}
+	logger.WithFields(headers).Info("Gateway request headers - action: ", handler.action, " path: ", request.URL.Path)
+}
+
+// call invoke the action with the params from the request and send the result back.
+func (handler *actionHandler) call(logger *log.Entry, request *http.Request, response http.ResponseWriter) {
+	requestID := requestIDFromRequest(request)
+	response.Header().Set(requestIDHeader, requestID)
+	handler.logHeaders(logger, request)
+	user, err := handler.authorize(request)
+	if err != nil {
+		logger.Debug("Gateway call() - action: ", handler.action, " not authorized - error: ", err)
+		handler.sendReponse(logger, request, payload.New(statusError{err.Error(), http.StatusUnauthorized}), response)
+		return
+	}
+	if user == nil {
+		user = userFromRequest(request)
+	}
+	trustProxy, _ := handler.settings["trustProxy"].(bool)
+	meta := payload.Empty().Add("requestID", requestID).Add("client", clientInfo(request, trustProxy))
+	if user != nil && user.Exists() {
+		meta = meta.Add("user", user)
+	}
+	if headers := handler.passHeaders(request); len(headers) > 0 {
+		meta = meta.Add("headers", headers)
+	}
+	params := handler.params(logger, request)
+	if _, coded := params.Error().(codedError); params.IsError() && coded {
+		logger.Debug("Gateway call() - action: ", handler.action, " invalid request - error: ", params.Error())
+		handler.sendReponse(logger, request, params, response)
+		return
+	}
+	if onBeforeCall, exists := handler.settings["onBeforeCall"].(func(moleculer.Context, *http.Request, moleculer.Payload) moleculer.Payload); exists {
+		params = onBeforeCall(handler.context, request, params)
+	}
+	var messages chan moleculer.Payload
+	if handler.isWS() {
+		messages = make(chan moleculer.Payload)
+		params = params.Add("messages", (<-chan moleculer.Payload)(messages))
+	}
+	if !handler.acquireCallSlot() {
+		logger.Warn("Gateway call() - action: ", handler.action, " rejected, maxConcurrent calls reached")
+		if messages != nil {
+			close(messages)
 		}
-	case http.MethodPut:
-		if methods["PUT"] {
-			handler.sendReponse(logger, <-handler.context.Call(handler.action, paramsFromRequest(request, logger)), response)
+		response.Header().Set("Retry-After", "1")
+		handler.sendReponse(logger, request, payload.New(statusError{"Service Unavailable - too many concurrent requests", http.StatusServiceUnavailable}), response)
+		return
+	}
+	result, timedOut := handler.callAction(logger, request, params, meta)
+	handler.releaseCallSlot()
+	if timedOut && request.Context().Err() != nil {
+		logger.Debug("Gateway call() - action: ", handler.action, " client disconnected before the action responded")
+		if messages != nil {
+			close(messages)
 		}
-	case http.MethodDelete:
-		if methods["DELETE"] {
-			handler.sendReponse(logger, <-handler.context.Call(handler.action, paramsFromRequest(request, logger)), response)
+		response.WriteHeader(clientClosedStatusCode)
+		return
+	}
+	if timedOut {
+		logger.Warn("Gateway call() - action: ", handler.action, " timed out")
+		if messages != nil {
+			close(messages)
 		}
+		handler.sendReponse(logger, request, payload.New(statusError{"Gateway Timeout - action: " + handler.action + " did not respond in time", http.StatusGatewayTimeout}), response)
+		return
+	}
+	if onAfterCall, exists := handler.settings["onAfterCall"].(func(moleculer.Context, http.ResponseWriter, moleculer.Payload) moleculer.Payload); exists {
+		result = onAfterCall(handler.context, response, result)
+	}
+	if handler.isWS() {
+		handler.bridgeWebSocket(logger, request, response, result, messages)
+		return
+	}
+	if result.IsError() && handler.onErrorHandler(response, result) {
+		return
+	}
+	handler.sendReponse(logger, request, result, response)
+}
+
+// acquireCallSlot take a slot for an action call without waiting, returns false when all the
+// maxConcurrent slots are in use.
+func (handler *actionHandler) acquireCallSlot() bool {
+	if handler.callSlots == nil {
+		return true
+	}
+	select {
+	case handler.callSlots <- true:
+		return true
 	default:
-		handler.invalidHttpMethodError(logger, response, methods)
+		return false
+	}
+}
+
+// releaseCallSlot free the slot taken by acquireCallSlot.
+func (handler *actionHandler) releaseCallSlot() {
+	if handler.callSlots != nil {
+		<-handler.callSlots
+	}
+}
+
+// waitResult wait for the action result, at most the callTimeout setting when configured.
+// returns true when the timeout is reached or the request is canceled (client disconnected)
+// before the action responds.
+func (handler *actionHandler) waitResult(request *http.Request, resultChan chan moleculer.Payload) (moleculer.Payload, bool) {
+	var timeoutChan <-chan time.Time
+	if timeout := durationSetting(handler.settings, "callTimeout"); timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+	select {
+	case result := <-resultChan:
+		return result, false
+	case <-timeoutChan:
+		return nil, true
+	case <-request.Context().Done():
+		return nil, true
+	}
+}
+
+// callAction call the action with the route callOptions: nodeID targets a node, retries repeat
+// the call while it returns an error and fallbackResponse (a value or a
+// func(moleculer.Context, moleculer.Payload) interface{}) replaces the error after the last retry.
+func (handler *actionHandler) callAction(logger *log.Entry, request *http.Request, params moleculer.Payload, meta moleculer.Payload) (moleculer.Payload, bool) {
+	callOptions, _ := handler.route["callOptions"].(map[string]interface{})
+	nodeID, _ := callOptions["nodeID"].(string)
+	retries, _ := callOptions["retries"].(int)
+	options := moleculer.Options{Meta: meta, NodeID: nodeID}
+	requestContext := handler.requestContext()
+	result, timedOut := handler.waitResult(request, requestContext.Call(handler.action, params, options))
+	for retry := 1; retry <= retries && !timedOut && result.IsError(); retry++ {
+		logger.Debug("Gateway callAction() - action: ", handler.action, " failed, retry: ", retry, " error: ", result.Error())
+		result, timedOut = handler.waitResult(request, requestContext.Call(handler.action, params, options))
+	}
+	fallback, hasFallback := callOptions["fallbackResponse"]
+	if timedOut || !result.IsError() || !hasFallback {
+		return result, timedOut
+	}
+	if fallbackFunc, isFunc := fallback.(func(moleculer.Context, moleculer.Payload) interface{}); isFunc {
+		return payload.New(fallbackFunc(handler.context, result)), false
 	}
+	return payload.New(copyFallback(fallback)), false
+}
+
+// copyFallback return a deep copy of the maps and slices of the fallbackResponse, so a request
+// changing its result (e.g. onAfterCall adding a field) doesn't change the configured value.
+func copyFallback(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			copied[key] = copyFallback(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for index, item := range value {
+			copied[index] = copyFallback(item)
+		}
+		return copied
+	}
+	return value
+}
+
+// requestContext return a context for the action calls of one request, with its own copy of the
+// service context meta. moleculer merges the call meta into the meta of the calling context, so
+// calling on the shared service context would leak the user and headers into the next requests.
+func (handler *actionHandler) requestContext() moleculer.Context {
+	withDelegates, ok := handler.context.(interface {
+		BrokerDelegates() *moleculer.BrokerDelegates
+	})
+	if !ok {
+		return handler.context
+	}
+	requestContext := molcontext.BrokerContext(withDelegates.BrokerDelegates())
+	if meta := handler.context.Meta(); meta != nil && meta.IsMap() {
+		requestContext.UpdateMeta(payload.Empty().AddMany(meta.RawMap()))
+	}
+	return requestContext.(moleculer.Context)
+}
+
+// onErrorHandler invoke the onError handler from settings with the error result.
+// returns false when no handler is configured, so the default error response should be sent.
+func (handler *actionHandler) onErrorHandler(response http.ResponseWriter, result moleculer.Payload) bool {
+	onError, exists := handler.settings["onError"].(func(moleculer.Context, http.ResponseWriter, moleculer.Payload))
+	if !exists {
+		return false
+	}
+	onError(handler.context, response, result)
+	return true
+}
+
+func (handler *actionHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	methods := handler.acceptedMethods()
+	logger := handler.context.Logger()
+	request = request.WithContext(context.WithValue(request.Context(), routeNameKey{}, handler.routeName))
+	if override := handler.methodOverride(request); override != "" {
+		logger.Debug("Gateway ServeHTTP() - action: ", handler.action, " method override: ", request.Method, " -> ", override)
+		request.Method = override
+	}
+	switch {
+	case request.Method == http.MethodOptions:
+		handler.sendOptions(response, methods)
+	case (handler.isSSE() || handler.isWS()) && request.Method != http.MethodGet:
+		handler.invalidHttpMethodError(logger, request, response, methods)
+	case request.Method == http.MethodHead && methods["GET"]:
+		headResponse := &headResponseWriter{ResponseWriter: response}
+		handler.call(logger, request, headResponse)
+		headResponse.finish()
+	case request.Method == http.MethodGet && methods["GET"] && handler.cache != nil && !handler.isSSE() && !handler.isWS():
+		handler.serveCached(request, response, func(response http.ResponseWriter) {
+			handler.call(logger, request, response)
+		})
+	case validMethod(request.Method) && methods[request.Method]:
+		handler.call(logger, request, response)
+	default:
+		handler.invalidHttpMethodError(logger, request, response, methods)
+	}
+}
+
+// methodOverrideHeader is sent by clients behind proxies that block methods like PUT and DELETE.
+var methodOverrideHeader = "X-HTTP-Method-Override"
+
+// methodOverride return the method from the X-HTTP-Method-Override header of POST requests when
+// the allowMethodOverride setting is on, or an empty string.
+func (handler *actionHandler) methodOverride(request *http.Request) string {
+	if allow, _ := handler.settings["allowMethodOverride"].(bool); !allow || request.Method != http.MethodPost {
+		return ""
+	}
+	override := strings.ToUpper(strings.TrimSpace(request.Header.Get(methodOverrideHeader)))
+	if !validMethod(override) {
+		return ""
+	}
+	return override
+}
+
+// aliasMethods parse the method token of an alias, multiple methods are separated by | e.g. "GET|POST".
+// valid is false when any of the methods is not supported.
+func aliasMethods(token string) (methods map[string]bool, valid bool) {
+	methods = map[string]bool{}
+	for _, method := range strings.Split(token, "|") {
+		method = strings.ToUpper(method)
+		if !validMethod(method) {
+			return nil, false
+		}
+		methods[method] = true
+	}
+	return methods, true
 }
 
 //acceptedMethods return a map of accepted methods for this handler.
+//the cache is set by populateActionsRouter before the handler serves requests, so it's never written concurrently.
 func (handler *actionHandler) acceptedMethods() map[string]bool {
 	if handler.acceptedMethodsCache != nil {
 		return handler.acceptedMethodsCache
 	}
+	return handler.allowedAliasMethods()
+}
+
+// allowedAliasMethods return the methods from the alias limited to the global allowedMethods setting, when present.
+func (handler *actionHandler) allowedAliasMethods() map[string]bool {
+	methods := handler.aliasAcceptedMethods()
+	if allowedMethods, exists := handler.settings["allowedMethods"].([]string); exists {
+		allowed := map[string]bool{}
+		for _, method := range allowedMethods {
+			method = strings.ToUpper(method)
+			allowed[method] = methods[method]
+		}
+		methods = allowed
+	}
+	return methods
+}
+
+// aliasAcceptedMethods return the methods accepted by the alias, all valid methods when the alias has none.
+func (handler *actionHandler) aliasAcceptedMethods() map[string]bool {
 	if handler.alias != "" {
 		parts := strings.Split(strings.TrimSpace(handler.alias), " ")
-		if len(parts) == 2 {
-			method := strings.ToUpper(parts[0])
-			if validMethod(method) {
-				handler.acceptedMethodsCache = map[string]bool{
-					method: true,
-				}
-				return handler.acceptedMethodsCache
+		if len(parts) >= 2 && (handler.isSSE() || handler.isWS()) {
+			return map[string]bool{"GET": true}
+		}
+		if len(parts) >= 2 {
+			if methods, valid := aliasMethods(parts[0]); valid {
+				return methods
 			}
 		}
 	}
-	handler.acceptedMethodsCache = map[string]bool{
+	return map[string]bool{
 		"GET":    true,
 		"POST":   true,
 		"PUT":    true,
 		"DELETE": true,
+		"PATCH":  true,
 	}
-	return handler.acceptedMethodsCache
 }
@@ -0,0 +1,201 @@
+package gateway
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var defaultCacheMaxEntries = 100
+
+// cachedResponse is a response stored in the cache with the time it was stored.
+type cachedResponse struct {
+	key        string
+	header     http.Header
+	statusCode int
+	body       []byte
+	stored     time.Time
+}
+
+// responseCache keep the most recently used responses until they expire.
+type responseCache struct {
+	mutex      sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List
+}
+
+// newResponseCache create the cache from the route cache settings, nil when the route is not cached.
+func newResponseCache(route map[string]interface{}) *responseCache {
+	cacheSettings, enabled := route["cache"].(map[string]interface{})
+	if !enabled {
+		return nil
+	}
+	ttl := durationSetting(cacheSettings, "ttl")
+	if ttl <= 0 {
+		return nil
+	}
+	maxEntries, exists := cacheSettings["maxEntries"].(int)
+	if !exists || maxEntries <= 0 {
+		maxEntries = defaultCacheMaxEntries
+	}
+	return &responseCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+// cacheKey return the key of the request: the path, query string and the Accept header,
+// since the serializer depends on it, and the headers sent to the action by passHeaders.
+func (handler *actionHandler) cacheKey(request *http.Request) string {
+	key := request.URL.RequestURI() + "|" + request.Header.Get("Accept")
+	headers := handler.passHeaders(request)
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key += "|" + name + "=" + headers[name].(string)
+	}
+	return key
+}
+
+// get return the response stored for the key, when it has not expired.
+func (cache *responseCache) get(key string) (*cachedResponse, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, exists := cache.entries[key]
+	if !exists {
+		return nil, false
+	}
+	entry := element.Value.(*cachedResponse)
+	if time.Since(entry.stored) >= cache.ttl {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	return entry, true
+}
+
+// set store the response, removing the least recently used one when the cache is full.
+func (cache *responseCache) set(entry *cachedResponse) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if element, exists := cache.entries[entry.key]; exists {
+		element.Value = entry
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[entry.key] = cache.order.PushFront(entry)
+	if cache.order.Len() > cache.maxEntries {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// cacheResponseWriter capture the status, headers and body written by the action handler, to be
+// stored in the cache. the handler writes the headers to its own map, copied to the response on
+// WriteHeader, so the headers set by the middlewares (e.g. Content-Encoding, CORS) are not stored.
+type cacheResponseWriter struct {
+	http.ResponseWriter
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *cacheResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *cacheResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode != 0 {
+		return
+	}
+	w.statusCode = statusCode
+	header := w.ResponseWriter.Header()
+	for name, values := range w.header {
+		header[name] = values
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *cacheResponseWriter) Write(bytes []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(bytes)
+	return w.ResponseWriter.Write(bytes)
+}
+
+// cacheable check if the response to the request can be cached, so a response is never sent to
+// another client. not cached: authenticated requests, requests with credentials (Authorization or
+// Cookie headers), routes requiring authorization and the params built from the request by a
+// paramMapper or onBeforeCall, which may depend on any header.
+func (handler *actionHandler) cacheable(request *http.Request) bool {
+	if required, _ := handler.route["authorization"].(bool); required {
+		return false
+	}
+	if request.Header.Get("Authorization") != "" || request.Header.Get("Cookie") != "" {
+		return false
+	}
+	if _, exists := handler.route["paramMapper"]; exists {
+		return false
+	}
+	if _, exists := handler.settings["onBeforeCall"]; exists {
+		return false
+	}
+	return userFromRequest(request) == nil
+}
+
+// serveCached send the cached response for the GET request when there is one, with the Age header,
+// otherwise call the action and cache the successful response.
+func (handler *actionHandler) serveCached(request *http.Request, response http.ResponseWriter, serve func(http.ResponseWriter)) {
+	if !handler.cacheable(request) {
+		serve(response)
+		return
+	}
+	key := handler.cacheKey(request)
+	if entry, exists := handler.cache.get(key); exists {
+		header := response.Header()
+		for name, values := range entry.header {
+			header[name] = append([]string(nil), values...)
+		}
+		header.Set(requestIDHeader, requestIDFromRequest(request))
+		header.Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+		if etag := entry.header.Get("ETag"); etag != "" && etagMatches(request.Header.Get("If-None-Match"), etag) {
+			response.WriteHeader(http.StatusNotModified)
+			return
+		}
+		response.WriteHeader(entry.statusCode)
+		response.Write(entry.body)
+		return
+	}
+	cacheResponse := &cacheResponseWriter{ResponseWriter: response, header: http.Header{}}
+	serve(cacheResponse)
+	if cacheResponse.statusCode != http.StatusOK {
+		return
+	}
+	header := http.Header{}
+	for name, values := range cacheResponse.header {
+		if name != requestIDHeader {
+			header[name] = append([]string(nil), values...)
+		}
+	}
+	handler.cache.set(&cachedResponse{
+		key:        key,
+		header:     header,
+		statusCode: cacheResponse.statusCode,
+		body:       cacheResponse.body.Bytes(),
+		stored:     time.Now(),
+	})
+}
@@ -1,20 +1,34 @@
 package gateway
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/moleculer-go/moleculer"
+	"github.com/moleculer-go/moleculer/broker"
 	"github.com/moleculer-go/moleculer/payload"
 	"github.com/moleculer-go/moleculer/serializer"
 	"github.com/moleculer-go/moleculer/service"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 var jsonSerializer = serializer.CreateJSONSerializer(log.WithField("gateway", "json-serializer"))
@@ -23,37 +37,69 @@ var actionWildCardRegex = regexp.MustCompile(`(.+)\.\*`)
 var serviceWildCardRegex = regexp.MustCompile(`\*\.(.+)`)
 var serviceActionRegex = regexp.MustCompile(`(.+)\.(.+)`)
 
-//shouldInclude check if the actions should be added based on the whitelist.
-func shouldInclude(whitelist []string, action string) bool {
-	for _, item := range whitelist {
-		if item == "**" || item == "*.*" {
+// actionPattern is a whitelist/blacklist item compiled once per route, so matching
+// the actions doesn't parse the items again.
+type actionPattern struct {
+	all     bool
+	literal string
+	service string
+	action  string
+	regex   *regexp.Regexp
+}
+
+// compilePatterns compile the whitelist/blacklist items into action patterns.
+// items between slashes (e.g. /^math\.\w+$/) are regular expressions matching the whole action name,
+// service.* and *.action are wildcards and any other item must be equal to the action name.
+func compilePatterns(items []string) []actionPattern {
+	patterns := make([]actionPattern, 0, len(items))
+	for _, item := range items {
+		pattern := actionPattern{all: item == "**" || item == "*.*"}
+		if len(item) > 1 && strings.HasPrefix(item, "/") && strings.HasSuffix(item, "/") {
+			if itemRegex, err := regexp.Compile("^(?:" + item[1:len(item)-1] + ")$"); err == nil {
+				pattern.regex = itemRegex
+			}
+		} else if whitelistService := actionWildCardRegex.FindStringSubmatch(item); len(whitelistService) > 1 {
+			pattern.service = whitelistService[1]
+		} else if whitelistAction := serviceWildCardRegex.FindStringSubmatch(item); len(whitelistAction) > 1 {
+			pattern.action = whitelistAction[1]
+		} else {
+			pattern.literal = item
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+//shouldInclude check if the actions should be added based on the whitelist patterns.
+func shouldInclude(whitelist []actionPattern, action string) bool {
+	var actionParts []string
+	for _, pattern := range whitelist {
+		if pattern.all || (pattern.literal != "" && pattern.literal == action) {
 			return true
 		}
-		whitelistService := actionWildCardRegex.FindStringSubmatch(item)
-		if len(whitelistService) > 0 && whitelistService[1] != "" {
-			actionService := serviceActionRegex.FindStringSubmatch(action)
-			if len(actionService) > 1 && len(whitelistService) > 1 && actionService[1] == whitelistService[1] {
-				return true
-			}
+		if (pattern.service != "" || pattern.action != "") && actionParts == nil {
+			actionParts = serviceActionRegex.FindStringSubmatch(action)
 		}
-		whitelistAction := serviceWildCardRegex.FindStringSubmatch(item)
-		if len(whitelistAction) > 0 && whitelistAction[1] != "" {
-			actionName := serviceActionRegex.FindStringSubmatch(action)
-			if len(actionName) > 2 && len(whitelistAction) > 1 && actionName[2] == whitelistAction[1] {
-				return true
-			}
+		if pattern.service != "" && len(actionParts) > 1 && actionParts[1] == pattern.service {
+			return true
 		}
-		itemRegex, err := regexp.Compile(item)
-		if err == nil {
-			if itemRegex.MatchString(action) {
-				return true
-			}
+		if pattern.action != "" && len(actionParts) > 2 && actionParts[2] == pattern.action {
+			return true
+		}
+		if pattern.regex != nil && pattern.regex.MatchString(action) {
+			return true
 		}
 	}
 	return false
 }
 
-var validMethods = []string{"GET", "POST", "PUT", "DELETE"}
+//shouldExclude check if the action should be removed based on the blacklist patterns.
+//same matching rules as the whitelist (see shouldInclude).
+func shouldExclude(blacklist []actionPattern, action string) bool {
+	return len(blacklist) > 0 && shouldInclude(blacklist, action)
+}
+
+var validMethods = []string{"GET", "POST", "PUT", "DELETE", "PATCH"}
 
 func validMethod(method string) bool {
 	for _, item := range validMethods {
@@ -64,38 +110,296 @@ func validMethod(method string) bool {
 	return false
 }
 
-func paramsFromRequestForm(request *http.Request, logger *log.Entry) (map[string]interface{}, error) {
+// valuesToParams convert url values into params. Single values are kept as scalars.
+// names in bracket notation are nested: filter[status]=active becomes {"filter": {"status": "active"}}
+// and tags[]=x&tags[]=y becomes {"tags": ["x", "y"]}. the alwaysArray names are arrays even with a single value.
+func valuesToParams(values url.Values, alwaysArray []string) map[string]interface{} {
 	params := map[string]interface{}{}
-	err := request.ParseForm()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	arrays := map[string]bool{}
+	for _, name := range alwaysArray {
+		arrays[name] = true
+	}
+	for _, name := range names {
+		keys := bracketKeys(name)
+		if len(keys) == 1 && arrays[name] {
+			keys = append(keys, "")
+		}
+		setNestedParam(params, keys, values[name])
+	}
+	return params
+}
+
+// bracketKeys split the name in bracket notation into its keys, a[b][] becomes a, b and "".
+// names that are not in bracket notation are returned as a single key.
+func bracketKeys(name string) []string {
+	open := strings.Index(name, "[")
+	if open <= 0 || !strings.HasSuffix(name, "]") {
+		return []string{name}
+	}
+	keys := []string{name[:open]}
+	for _, key := range strings.Split(name[open+1:len(name)-1], "][") {
+		if strings.ContainsAny(key, "[]") {
+			return []string{name}
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// setNestedParam set the values in the params following the keys, creating the nested maps.
+// an empty last key ([]) appends the values to an array.
+func setNestedParam(params map[string]interface{}, keys []string, values []string) {
+	for index, key := range keys[:len(keys)-1] {
+		if keys[index+1] == "" && index+1 == len(keys)-1 {
+			items, _ := params[key].([]interface{})
+			for _, value := range values {
+				items = append(items, value)
+			}
+			params[key] = items
+			return
+		}
+		nested, isMap := params[key].(map[string]interface{})
+		if !isMap {
+			nested = map[string]interface{}{}
+			params[key] = nested
+		}
+		params = nested
+	}
+	key := keys[len(keys)-1]
+	if len(values) == 1 {
+		params[key] = values[0]
+	} else {
+		params[key] = values
+	}
+}
+
+// defaultMaxUploadSize max size of multipart forms when maxUploadSize is not set.
+var defaultMaxUploadSize = int64(32 << 20)
+
+// maxUploadSize return the maxUploadSize setting, the max size of multipart forms.
+func maxUploadSize(settings map[string]interface{}) int64 {
+	switch value := settings["maxUploadSize"].(type) {
+	case int:
+		return int64(value)
+	case int64:
+		return value
+	}
+	return defaultMaxUploadSize
+}
+
+// maxBodySize return the maxBodySize setting, the max size of the request body. zero means no limit.
+func maxBodySize(settings map[string]interface{}) int64 {
+	switch value := settings["maxBodySize"].(type) {
+	case int:
+		return int64(value)
+	case int64:
+		return value
+	}
+	return 0
+}
+
+// bodyTooLargeError return a 413 error when err was caused by a body over the maxBodySize limit.
+func bodyTooLargeError(err error) (moleculer.Payload, bool) {
+	if !strings.Contains(err.Error(), "http: request body too large") {
+		return nil, false
+	}
+	return payload.New(statusError{"Request Entity Too Large", http.StatusRequestEntityTooLarge}), true
+}
+
+// badRequestError return a 400 error for request params that could not be parsed,
+// so malformed client input is not reported as a server error.
+func badRequestError(message ...interface{}) moleculer.Payload {
+	return payload.New(statusError{fmt.Sprint(message...), http.StatusBadRequest})
+}
+
+// fileToParams read the uploaded file into params with filename, size, contentType and bytes.
+func fileToParams(fileHeader *multipart.FileHeader) (map[string]interface{}, error) {
+	file, err := fileHeader.Open()
 	if err != nil {
-		logger.Error("Error calling request.ParseForm() -> ", err)
 		return nil, err
 	}
-	for name, value := range request.Form {
-		if len(value) == 1 {
-			params[name] = value[0]
+	defer file.Close()
+	bts, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"filename":    fileHeader.Filename,
+		"size":        fileHeader.Size,
+		"contentType": fileHeader.Header.Get("Content-Type"),
+		"bytes":       bts,
+	}, nil
+}
+
+// filesToParams convert the uploaded files into params. Single files are kept as a map.
+func filesToParams(files map[string][]*multipart.FileHeader) (map[string]interface{}, error) {
+	params := map[string]interface{}{}
+	for name, fileHeaders := range files {
+		list := []map[string]interface{}{}
+		for _, fileHeader := range fileHeaders {
+			file, err := fileToParams(fileHeader)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, file)
+		}
+		if len(list) == 1 {
+			params[name] = list[0]
 		} else {
-			params[name] = value
+			params[name] = list
 		}
 	}
 	return params, nil
 }
 
-// paramsFromRequest extract params from body and URL into a payload.
-func paramsFromRequest(request *http.Request, logger *log.Entry) moleculer.Payload {
-	mvalues, err := paramsFromRequestForm(request, logger)
+// paramsFromRequestForm extract the form values sent in the request body.
+// uploaded files from multipart forms are added to the "files" param. the request is a copy (made by
+// mux and ServeHTTP), so net/http won't remove the temp files of the form, they are removed here.
+func paramsFromRequestForm(request *http.Request, settings map[string]interface{}, alwaysArray []string, logger *log.Entry) (map[string]interface{}, error) {
+	if strings.HasPrefix(request.Header.Get("Content-Type"), "multipart/form-data") {
+		uploadSize := maxUploadSize(settings)
+		if request.Body != nil {
+			request.Body = http.MaxBytesReader(nil, request.Body, uploadSize)
+		}
+		err := request.ParseMultipartForm(uploadSize)
+		if err != nil {
+			logger.Error("Error calling request.ParseMultipartForm() -> ", err)
+			return nil, err
+		}
+		defer request.MultipartForm.RemoveAll()
+		params := valuesToParams(request.MultipartForm.Value, alwaysArray)
+		if len(request.MultipartForm.File) > 0 {
+			files, err := filesToParams(request.MultipartForm.File)
+			if err != nil {
+				logger.Error("Error reading uploaded files -> ", err)
+				return nil, err
+			}
+			params["files"] = files
+		}
+		return params, nil
+	}
+	err := request.ParseForm()
+	if err != nil {
+		logger.Error("Error calling request.ParseForm() -> ", err)
+		return nil, err
+	}
+	return valuesToParams(request.PostForm, alwaysArray), nil
+}
+
+// paramsFromRequestBody extract params from the body, either form values or a body
+// parsed with the serializer for the Content-Type (the serializer setting, JSON by default).
+func paramsFromRequestBody(request *http.Request, settings map[string]interface{}, alwaysArray []string, logger *log.Entry) moleculer.Payload {
+	mvalues, err := paramsFromRequestForm(request, settings, alwaysArray, logger)
 	if len(mvalues) > 0 {
 		return payload.New(mvalues)
 	}
 	if err != nil {
-		return payload.Error("Error trying to parse request form values. Error: ", err.Error())
+		if tooLarge, is := bodyTooLargeError(err); is {
+			return tooLarge
+		}
+		return badRequestError("Error trying to parse request form values. Error: ", err.Error())
+	}
+	if request.Body == nil {
+		return payload.New(nil)
 	}
-
 	bts, err := ioutil.ReadAll(request.Body)
 	if err != nil {
-		return payload.Error("Error trying to parse request body. Error: ", err.Error())
+		if tooLarge, is := bodyTooLargeError(err); is {
+			return tooLarge
+		}
+		return badRequestError("Error trying to parse request body. Error: ", err.Error())
+	}
+	contentType := request.Header.Get("Content-Type")
+	params := serializerForContentType(contentType, settings).BytesToPayload(&bts)
+	if params.IsError() {
+		return badRequestError(params.Error().Error())
+	}
+	_, customSerializer := settings["serializer"]
+	isJSON := !customSerializer && (contentType == "" || strings.Contains(contentType, "json"))
+	if isJSON && len(bytes.TrimSpace(bts)) > 0 && !gjson.ValidBytes(bts) {
+		return badRequestError("Error trying to parse request body. Error: invalid JSON")
+	}
+	return params
+}
+
+var defaultParamPrecedence = []string{"path", "body", "query"}
+
+// paramPrecedence return the order in which the param sources win on key collisions, from the
+// route or service "paramPrecedence" setting. sources missing in the setting get the lowest precedence.
+func paramPrecedence(route, settings map[string]interface{}) []string {
+	precedence, exists := route["paramPrecedence"].([]string)
+	if !exists {
+		precedence, _ = settings["paramPrecedence"].([]string)
 	}
-	return jsonSerializer.BytesToPayload(&bts)
+	result := append([]string{}, precedence...)
+	for _, source := range defaultParamPrecedence {
+		found := false
+		for _, item := range precedence {
+			found = found || item == source
+		}
+		if !found {
+			result = append(result, source)
+		}
+	}
+	return result
+}
+
+// pathParams return the variables captured from the path (e.g. /users/{id}).
+func pathParams(request *http.Request) map[string]interface{} {
+	values := map[string]interface{}{}
+	for name, value := range mux.Vars(request) {
+		values[name] = value
+	}
+	return values
+}
+
+// mergeParams merge the path, body and query string params. when the same param is present in
+// more than one source the first source in the precedence wins.
+// bodies that are not maps (e.g. arrays) can't be merged and are returned as is.
+func mergeParams(precedence []string, path, query map[string]interface{}, body moleculer.Payload) moleculer.Payload {
+	if (len(path) == 0 && len(query) == 0) || (body.Exists() && !body.IsMap()) {
+		return body
+	}
+	sources := map[string]map[string]interface{}{"path": path, "query": query}
+	if body.IsMap() {
+		sources["body"] = body.RawMap()
+	}
+	values := map[string]interface{}{}
+	for index := len(precedence) - 1; index >= 0; index-- {
+		for name, value := range sources[precedence[index]] {
+			values[name] = value
+		}
+	}
+	return payload.New(values)
+}
+
+// paramsFromRequest extract params from query string, body and path into a payload.
+// When the same param is present in more than one source the precedence is the
+// "paramPrecedence" setting, by default: path params > body params > query string params.
+func paramsFromRequest(request *http.Request, settings map[string]interface{}, logger *log.Entry) moleculer.Payload {
+	return paramsFromRequestOrdered(request, settings, paramPrecedence(nil, settings), nil, logger)
+}
+
+// paramsFromRequestOrdered extract the params like paramsFromRequest with the given precedence.
+// the alwaysArray form and query string params are arrays even when sent with a single value.
+func paramsFromRequestOrdered(request *http.Request, settings map[string]interface{}, precedence, alwaysArray []string, logger *log.Entry) moleculer.Payload {
+	if limit := maxBodySize(settings); limit > 0 && request.Body != nil {
+		request.Body = http.MaxBytesReader(nil, request.Body, limit)
+	}
+	body := paramsFromRequestBody(request, settings, alwaysArray, logger)
+	if body.IsError() {
+		return body
+	}
+	params := mergeParams(precedence, pathParams(request), valuesToParams(request.URL.Query(), alwaysArray), body)
+	if level, enabled := logLevelSetting(settings, "logRequestParams"); enabled {
+		logger.Log(level, "Gateway paramsFromRequest() - path: ", request.URL.Path, " params: ", params.Value())
+	}
+	return params
 }
 
 func invertStringMap(in map[string]string) map[string]string {
@@ -106,9 +410,109 @@ func invertStringMap(in map[string]string) map[string]string {
 	return out
 }
 
+// restActions map the CRUD action names to the alias generated by the REST shorthand.
+var restActions = []struct {
+	action string
+	alias  string
+}{
+	{"list", "GET %s"},
+	{"get", "GET %s/:id"},
+	{"create", "POST %s"},
+	{"update", "PUT %s/:id"},
+	{"remove", "DELETE %s/:id"},
+}
+
+// expandRestAliases replace the REST shorthand aliases, e.g. "REST users": "users", with the
+// aliases for the list, get, create, update and remove actions of the service.
+func expandRestAliases(aliases map[string]string) map[string]string {
+	result := make(map[string]string, len(aliases))
+	for alias, value := range aliases {
+		parts := strings.Fields(alias)
+		if len(parts) != 2 || strings.ToUpper(parts[0]) != "REST" {
+			result[alias] = value
+			continue
+		}
+		for _, rest := range restActions {
+			result[fmt.Sprintf(rest.alias, parts[1])] = value + "." + rest.action
+		}
+	}
+	return result
+}
+
+// wildcardAlias is an alias whose value is a wildcard (e.g. "users.*") with its compiled pattern.
+type wildcardAlias struct {
+	alias    string
+	patterns []actionPattern
+}
+
+// wildcardAliasList return the aliases whose value is a wildcard (e.g. "users.*") sorted by alias,
+// so the expansion does not depend on the map order.
+func wildcardAliasList(aliases map[string]string) []wildcardAlias {
+	keys := []string{}
+	for alias, action := range aliases {
+		if strings.Contains(action, "*") {
+			keys = append(keys, alias)
+		}
+	}
+	sort.Strings(keys)
+	result := make([]wildcardAlias, len(keys))
+	for index, alias := range keys {
+		result[index] = wildcardAlias{alias, compilePatterns([]string{aliases[alias]})}
+	}
+	return result
+}
+
+// expandWildcardAlias find a wildcard alias matching the action and replace the
+// {action} (or :action) placeholder with the action name. e.g. "users/{action}": "users.*"
+// becomes "users/list" for the action users.list.
+func expandWildcardAlias(wildcardAliases []wildcardAlias, action string) (string, bool) {
+	actionName := action
+	if index := strings.LastIndex(action, "."); index >= 0 {
+		actionName = action[index+1:]
+	}
+	for _, wildcard := range wildcardAliases {
+		if shouldInclude(wildcard.patterns, action) {
+			expanded := strings.Replace(wildcard.alias, "{action}", actionName, -1)
+			return strings.Replace(expanded, ":action", actionName, -1), true
+		}
+	}
+	return "", false
+}
+
+// validAliases return the aliases without the invalid ones, which are logged and skipped.
+func validAliases(aliases map[string]string, logger *log.Entry) map[string]string {
+	result := make(map[string]string, len(aliases))
+	for alias, action := range aliases {
+		if err := validateAlias(alias); err != nil {
+			logger.Warn("Gateway skipping alias for action: ", action, " - error: ", err)
+			continue
+		}
+		result[alias] = action
+	}
+	return result
+}
+
+// warnUnknownAliasActions log a warning for the aliases mapped to an action that is not in the list
+// of exposed actions, e.g. a typo in the action name. wildcard aliases are not checked.
+func warnUnknownAliasActions(aliases map[string]string, actions []string, logger *log.Entry) {
+	known := make(map[string]bool, len(actions))
+	for _, action := range actions {
+		known[action] = true
+	}
+	for alias, action := range aliases {
+		if !known[action] && !strings.Contains(action, "*") {
+			logger.Warn("Gateway alias: ", alias, " maps to unknown action: ", action)
+		}
+	}
+}
+
 //createActionHandlers create actionHanler for each action with the prefixPath.
-func createActionHandlers(route map[string]interface{}, actions []string) []*actionHandler {
+func createActionHandlers(route map[string]interface{}, actions []string, logger *log.Entry) []*actionHandler {
 	routePath := route["path"].(string)
+	routeName, exists := route["name"].(string)
+	if !exists {
+		routeName = routePath
+	}
 	mappingPolicy, exists := route["mappingPolicy"].(string)
 	if !exists {
 		mappingPolicy = "all"
@@ -117,15 +521,22 @@ func createActionHandlers(route map[string]interface{}, actions []string) []*act
 	if !exists {
 		aliases = map[string]string{}
 	}
+	pathMapper, _ := route["pathMapper"].(func(string) string)
+	aliases = validAliases(expandRestAliases(aliases), logger)
+	warnUnknownAliasActions(aliases, actions, logger)
 	actionToAlias := invertStringMap(aliases)
+	wildcardAliases := wildcardAliasList(aliases)
 
 	result := []*actionHandler{}
 	for _, action := range actions {
 		actionAlias, exists := actionToAlias[action]
+		if !exists {
+			actionAlias, exists = expandWildcardAlias(wildcardAliases, action)
+		}
 		if !exists && mappingPolicy == "restrict" {
 			continue
 		}
-		result = append(result, &actionHandler{alias: actionAlias, routePath: routePath, action: action})
+		result = append(result, &actionHandler{alias: actionAlias, routeName: routeName, routePath: routePath, action: action, route: route, cache: newResponseCache(route), pathMapper: pathMapper})
 	}
 	return result
 }
@@ -143,54 +554,203 @@ func fetchServices(context moleculer.Context) []map[string]interface{} {
 	return services.MapArray()
 }
 
+// expandRoutes replace the routes with "children" by their children, each one inheriting the
+// settings of the parent (e.g. whitelist, authorization, responseHeaders) and overriding the ones it sets.
+// children can have children of their own.
+func expandRoutes(routes []map[string]interface{}) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	for _, route := range routes {
+		children, hasChildren := route["children"].([]map[string]interface{})
+		if !hasChildren {
+			result = append(result, route)
+			continue
+		}
+		for _, child := range children {
+			merged := map[string]interface{}{}
+			for key, value := range route {
+				if key != "children" {
+					merged[key] = value
+				}
+			}
+			for key, value := range child {
+				merged[key] = value
+			}
+			result = append(result, expandRoutes([]map[string]interface{}{merged})...)
+		}
+	}
+	return result
+}
+
 //filterActions with a list of services collect all actions, applyfilter based on
 // whitelist settings and create action handlers for each action.
 func filterActions(context moleculer.Context, settings map[string]interface{}, services []map[string]interface{}) []*actionHandler {
 	result := []*actionHandler{}
-	routes := settings["routes"].([]map[string]interface{})
+	routes := expandRoutes(settings["routes"].([]map[string]interface{}))
 	for _, route := range routes {
+		if !routeEnabled(route) {
+			continue
+		}
 		filteredActions := []string{}
 		_, exists := route["whitelist"]
-		whitelist := []string{"**"}
+		whitelistItems := []string{"**"}
 		if exists {
-			whitelist = route["whitelist"].([]string)
+			whitelistItems = route["whitelist"].([]string)
 		}
+		blacklistItems, _ := route["blacklist"].([]string)
+		whitelist, blacklist := compilePatterns(whitelistItems), compilePatterns(blacklistItems)
 		for _, service := range services {
 			actions := service["actions"].(map[string]map[string]interface{})
 			for _, action := range actions {
 				actionFullName := action["name"].(string)
-				if shouldInclude(whitelist, actionFullName) {
+				if shouldInclude(whitelist, actionFullName) && !shouldExclude(blacklist, actionFullName) {
 					filteredActions = append(filteredActions, actionFullName)
 				}
 			}
 		}
-		for _, actionHand := range createActionHandlers(route, filteredActions) {
+		for _, actionHand := range createActionHandlers(route, filteredActions, context.Logger()) {
+			if actionHand.pathMapper == nil {
+				actionHand.pathMapper, _ = settings["pathMapper"].(func(string) string)
+			}
 			result = append(result, actionHand)
 		}
 	}
 	return result
 }
 
+// routeEnabled check the route "enabled" setting, a bool or a func() bool evaluated on each rebuild.
+// routes without it are enabled.
+func routeEnabled(route map[string]interface{}) bool {
+	switch enabled := route["enabled"].(type) {
+	case bool:
+		return enabled
+	case func() bool:
+		return enabled()
+	}
+	return true
+}
+
+// moreSpecific check if the pattern a is more specific than b: patterns with fewer path params
+// come first, then the ones with more segments and then the longer ones.
+func moreSpecific(a, b string) bool {
+	paramsA, paramsB := strings.Count(a, "{"), strings.Count(b, "{")
+	if paramsA != paramsB {
+		return paramsA < paramsB
+	}
+	segmentsA, segmentsB := strings.Count(a, "/"), strings.Count(b, "/")
+	if segmentsA != segmentsB {
+		return segmentsA > segmentsB
+	}
+	return len(a) > len(b)
+}
+
+// sortBySpecificity sort the handlers so the more specific patterns are registered first
+// and are not shadowed by generic ones.
+func sortBySpecificity(handlers []*actionHandler) {
+	sort.SliceStable(handlers, func(i, j int) bool {
+		return moreSpecific(handlers[i].pattern(), handlers[j].pattern())
+	})
+}
+
 var defaultRoutes = []map[string]interface{}{
 	map[string]interface{}{
+		//name identifies the route, available in hooks via RouteName(request). Defaults to the path.
+		"name": "default",
+
 		"path": "/",
 
 		//whitelist filter used to filter the list of actions.
-		//accept regex, and wildcard on action name
+		//accept regex (between slashes, matching the whole name), wildcard and exact action names
 		//regex: /^math\.\w+$/
 		//wildcard: posts.*
+		//exact: posts.list
 		"whitelist": []string{"**"},
 
+		//blacklist filter used to remove actions that passed the whitelist.
+		//same rules as the whitelist, e.g. []string{"users.remove", "$node.*"}
+		// "blacklist": []string{},
+
 		//mappingPolicy -> all : include all actions, the ones with aliases and without.
 		//mappingPolicy -> restrict : include only actions that are in the list of aliases.
 		"mappingPolicy": "all",
 
+		//successCode -> status code sent on successful responses. default: 200
+		//aliases can also set it: "POST users 201"
+		// "successCode": 200,
+
 		//aliases -> alias names instead of action names.
+		//the method is optional and several methods can be separated by |, e.g. "GET|POST users".
+		//wildcard values map all matching actions, {action} is replaced by the action name.
+		//"REST posts" maps GET posts, GET posts/:id, POST posts, PUT posts/:id and DELETE posts/:id
+		//to the actions posts.list, posts.get, posts.create, posts.update and posts.remove.
+		//"SSE notifications" streams the action chan as Server-Sent Events and "WS chat" bridges a
+		//WebSocket with the action: client messages go to params "messages" and the returned chan to the client.
 		// "aliases": map[string]interface{}{
-		// 	"login": "auth.login"
+		// 	"login": "auth.login",
+		// 	"users/{action}": "users.*",
+		// 	"REST posts": "posts",
+		// 	"WS chat": "chat.connect",
+		// },
+
+		//enabled -> false skips the route, e.g. debug routes only in dev. also accepts a func() bool.
+		// "enabled": os.Getenv("ENV") == "dev",
+
+		//children -> routes that inherit the settings of this route and override the ones they set.
+		//a route with children is only a group, its actions are mapped by the children.
+		// "children": []map[string]interface{}{
+		// 	{"path": "/admin", "authorization": true},
+		// },
+
+		//cors -> CORS settings of this route, used instead of the global cors settings,
+		//e.g. open origins for a public widget route while the others stay locked down.
+		// "cors": map[string]interface{}{
+		// 	"allowedOrigins": []string{"*"},
 		// },
 
-		//authorization turn on/off authorization
+		//responseHeaders -> headers added to all responses of this route.
+		// "responseHeaders": map[string]string{
+		// 	"Cache-Control":   "no-store",
+		// 	"X-Frame-Options": "DENY",
+		// },
+
+		//raw -> send the string or bytes returned by the actions as is, instead of serialized as JSON,
+		//with the contentType (default text/plain), e.g. for actions returning HTML or CSV. errors are still JSON.
+		// "raw":         true,
+		// "contentType": "text/csv",
+
+		//logHeaders -> log these request headers for each request, e.g. to debug auth issues.
+		//headers not listed are not logged.
+		// "logHeaders": []string{"X-Request-ID", "X-Tenant"},
+
+		//cache -> keep the successful GET responses for the ttl, by path, query string and Accept header,
+		//up to maxEntries (default 100) per action. cached responses are shared by all the clients, so
+		//authenticated requests, requests with Authorization or Cookie headers, routes with authorization
+		//or paramMapper and services with onBeforeCall are not cached. passHeaders are part of the key.
+		// "cache": map[string]interface{}{
+		// 	"ttl":        time.Minute,
+		// 	"maxEntries": 100,
+		// },
+
+		//paramPrecedence -> which source wins when a param is in the path, body and query string.
+		//default: path, body, query. the service settings can also set it for all routes.
+		// "paramPrecedence": []string{"path", "body", "query"},
+
+		//alwaysArray -> form and query string params sent as arrays even when they have a single value.
+		// "alwaysArray": []string{"tags"},
+
+		//paramMapper -> replaces the params extracted from the path, body and query string.
+		// "paramMapper": func(req *http.Request) moleculer.Payload {
+		// 	return payload.Empty().Add("tenant", req.Header.Get("X-Tenant"))
+		// },
+
+		//callOptions -> options of the action calls. use children routes for options per alias.
+		// "callOptions": map[string]interface{}{
+		// 	"retries":          2,
+		// 	"nodeID":           "node-1",
+		// 	"fallbackResponse": map[string]interface{}{"items": []interface{}{}},
+		// },
+
+		//authorization turn on/off authorization. When on, the "authorize" function
+		//from settings is invoked before calling the action.
 		"authorization": false,
 	},
 }
@@ -198,26 +758,222 @@ var defaultRoutes = []map[string]interface{}{
 var defaultSettings = map[string]interface{}{
 
 	// reverseProxy define a reverse proxy for local development and avoid CORS issues :)
+	// a list maps several targetPaths to their targets, e.g. for micro-frontends. the actions
+	// are served on the gatewayPath of the first one.
+	// "reverseProxy": []map[string]interface{}{
+	// 	{"gatewayPath": "/api", "targetPath": "/admin", "target": "http://localhost:4000"},
+	// 	{"targetPath": "/", "target": "http://localhost:3000"},
+	// },
 	"reverseProxy": false,
 
 	// setupRoutes is a list of delegates to be invoked when setting up the http server.
 	// this allows for other mixins that are combined with the Http gateway
 	"setupRoutes": []func(moleculer.BrokerContext, *mux.Router){},
 
+	// authorize is invoked before the action call on routes with authorization turned on.
+	// the returned payload is sent to the action as meta "user", an error responds with 401.
+	// "authorize": func(ctx moleculer.Context, route map[string]interface{}, req *http.Request) (moleculer.Payload, error) {
+	// 	return payload.Empty().Add("id", "user-id"), nil
+	// },
+
+	// auth built-in authentication for all requests.
+	// bearer validate the token from the Authorization: Bearer header, the returned payload
+	// is sent to the action as meta "user" and an error responds with 401.
+	// basic check the Authorization: Basic header against a map of usernames to bcrypt hashes,
+	// the username is sent to the action as meta "user". routes accept the same "auth" setting.
+	// "auth": map[string]interface{}{
+	// 	"bearer": func(token string) (moleculer.Payload, error) {
+	// 		return payload.Empty().Add("id", "user-id"), nil
+	// 	},
+	// 	"basic": map[string]string{
+	// 		"admin": "$2a$10$...",
+	// 	},
+	// },
+
+	// trustProxy use the X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers for the client
+	// ip, scheme and host (rate limit, access log and the "client" meta of the actions).
+	// enable only behind a trusted proxy, since clients can send these headers. the client ip is the
+	// last X-Forwarded-For entry, the one appended by the proxy.
+	"trustProxy": false,
+
+	// rateLimit limit the requests per client IP, requests over the limit get 429 with Retry-After.
+	// trustForwardedFor use the last X-Forwarded-For entry, appended by the proxy, as the client IP
+	// (only behind a trusted proxy).
+	// the client IPs without requests for a minute (or the time to refill the burst, when longer) are forgotten.
+	// "rateLimit": map[string]interface{}{
+	// 	"requestsPerSecond": 10,
+	// 	"burst":             20,
+	// 	"trustForwardedFor": false,
+	// },
+
+	// onBeforeCall is invoked before the action call and the returned payload is used as the action params.
+	// "onBeforeCall": func(ctx moleculer.Context, req *http.Request, params moleculer.Payload) moleculer.Payload {
+	// 	return params.Add("token", req.Header.Get("Authorization"))
+	// },
+
+	// onAfterCall is invoked with the action result (success or error) and the returned payload is sent in the response.
+	// "onAfterCall": func(ctx moleculer.Context, resp http.ResponseWriter, result moleculer.Payload) moleculer.Payload {
+	// 	return payload.Empty().Add("data", result)
+	// },
+
+	// onError is invoked when the action returns an error and is responsible for writing the response.
+	// "onError": func(ctx moleculer.Context, resp http.ResponseWriter, err moleculer.Payload) {
+	// 	resp.WriteHeader(400)
+	// },
+
 	// Exposed port
 	"port": "3100",
 
+	// basePath prefix of all the action routes, e.g. "/api/v1" when deployed behind an ingress
+	// that doesn't strip it. the routes and aliases are resolved after it.
+	"basePath": "",
+
+	// callTimeout max time to wait for an action to respond before sending 504 Gateway Timeout.
+	// zero means wait until the action responds.
+	"callTimeout": time.Duration(0),
+
+	// maxUploadSize max size (bytes) of multipart forms, the uploaded files are read into memory.
+	// larger forms get 413 Request Entity Too Large.
+	"maxUploadSize": defaultMaxUploadSize,
+
+	// maxBodySize max size (bytes) of the request body, larger bodies get 413 Request Entity Too Large.
+	// zero means no limit.
+	"maxBodySize": 0,
+
+	// maxConcurrent max number of action calls in flight at the same time, to protect the services.
+	// requests over the limit get 503 Service Unavailable with Retry-After. zero means no limit.
+	"maxConcurrent": 0,
+
+	// rebuildDebounce wait for the registry events to settle for this window before rebuilding the
+	// action routes, so a burst of services added results in a single rebuild. zero rebuilds on every event.
+	"rebuildDebounce": time.Duration(0),
+
+	// readTimeout, writeTimeout and idleTimeout of the http server. zero means no timeout.
+	"readTimeout":  time.Duration(0),
+	"writeTimeout": time.Duration(0),
+	"idleTimeout":  time.Duration(0),
+
+	// maxHeaderBytes max size of the request headers. zero uses the http.DefaultMaxHeaderBytes.
+	"maxHeaderBytes": 0,
+
+	// drainTimeout max time to wait for active connections to finish when the service stops.
+	// connections still open after it are closed. the old name shutdownTimeout is also accepted.
+	"drainTimeout": 10 * time.Second,
+
 	// Exposed IP
 	"ip": "0.0.0.0",
 
-	// Used server instance. If null, it will create a new HTTP(s)(2) server
-	// If false, it will start without server in middleware mode
-	//"server": true,
+	// network used to listen: "tcp", "tcp4", "tcp6" or "unix".
+	"network": "tcp",
+
+	// socket path used when network is "unix"
+	// "socket": "/tmp/gateway.sock",
 
-	// Log the request ctx.params (default to "debug" level)
+	// listen addresses served by the gateway, one server each with the same handler, instead of ip:port.
+	// they use the network setting, with socket paths for the unix network.
+	// "listen": []string{"10.0.0.5:3100", "0.0.0.0:8080"},
+
+	// compression gzip responses larger than threshold (bytes) when the client accepts it.
+	// use true to enable with the default threshold.
+	// "compression": map[string]interface{}{
+	// 	"threshold": 1024,
+	// },
+
+	// tls serve over HTTPS when both certFile and keyFile are provided.
+	// "tls": map[string]interface{}{
+	// 	"certFile": "./cert.pem",
+	// 	"keyFile":  "./key.pem",
+	// },
+
+	// cors enable CORS support when present. Absent means CORS is disabled.
+	// "cors": map[string]interface{}{
+	// 	"allowedOrigins":   []string{"http://localhost:3000"},
+	// 	"allowedMethods":   []string{"GET", "POST"},
+	// 	"allowedHeaders":   []string{"Content-Type"},
+	// 	"allowCredentials": false,
+	// },
+
+	// server is an *http.Server to attach the gateway handler to, instead of creating one.
+	// false starts the gateway in middleware mode, without a server (see Handler).
+	// the gateway doesn't start or stop it, e.g. when embedding the gateway in an existing server.
+	// "server": &http.Server{Addr: ":8080"},
+
+	// listener is a net.Listener the gateway serves on, instead of listening on ip:port.
+	// "listener": listener,
+
+	// notFoundHandler handle requests that don't match any route, default responds 404 with a JSON error.
+	// "notFoundHandler": http.NotFoundHandler(),
+
+	// passHeaders request headers sent to the actions as meta "headers", e.g. the language or tenant.
+	// routes accept the same setting.
+	// "passHeaders": []string{"Accept-Language", "X-Tenant"},
+
+	// pathMapper translate the action names into the paths of the actions without alias, instead of
+	// replacing the dots by slashes (users.list -> users/list). routes accept the same setting.
+	// "pathMapper": func(action string) string {
+	// 	return strings.ToLower(strings.Replace(action, ".", "/", -1))
+	// },
+
+	// allowMethodOverride POST requests with the X-HTTP-Method-Override header are handled as the
+	// method in the header, for clients behind proxies that block methods like PUT and DELETE.
+	"allowMethodOverride": false,
+
+	// allowedMethods limit the methods accepted by all the routes, e.g. []string{"GET"} for a read-only gateway.
+	// "allowedMethods": []string{"GET", "POST", "PUT", "DELETE", "PATCH"},
+
+	// serializer used for the JSON request bodies and responses, websocket messages and event streams,
+	// instead of the default JSON serializer. it must implement BytesToPayload and PayloadToBytes.
+	// "serializer": serializer.CreateJSONSerializer(log.WithField("gateway", "serializer")),
+
+	// errorEnvelope when true errors are sent as {"error": {"message": ..., "code": ..., "type": ...}}
+	// instead of {"error": message}, for the action errors and the gateway errors (401, 429, 503...).
+	// it also accepts a func(error, int) interface{} with a custom envelope.
+	"errorEnvelope": false,
+
+	// errorTemplates render the error responses of a status code with a text/template, which gets the
+	// Message, Name and Code of the error and a json function to quote values, or with a
+	// func(error, int) interface{} returning the value to serialize. other status codes use the default body.
+	// they apply to the action errors and the errors of the gateway (e.g. 401, 429, 502, 503).
+	// "errorTemplates": map[int]interface{}{
+	// 	404: `{"status": "missing", "detail": {{json .Message}}}`,
+	// 	500: func(err error, code int) interface{} {
+	// 		return map[string]interface{}{"status": "failed", "detail": err.Error()}
+	// 	},
+	// },
+
+	// successEnvelope when true successful results are sent as {"data": result}.
+	"successEnvelope": false,
+
+	// healthPath path of the health check endpoint, which reports the gateway status
+	// without calling any action. empty string disables it.
+	"healthPath": "/~health",
+
+	// requiredServices the health check responds 503 (not ready) until all these services are
+	// available, so orchestrators don't send traffic before the backing services are registered.
+	// "requiredServices": []string{"users", "orders"},
+
+	// routesPath path of the endpoint listing the action routes (path, methods and action).
+	// empty string disables it, e.g. in production.
+	"routesPath": "/~routes",
+
+	// openapiPath path of the endpoint with a minimal OpenAPI document of the action routes.
+	// empty string disables it.
+	// "openapiPath": "/~openapi",
+
+	// accessLog log each request with method, path, status, duration and response size.
+	"accessLog": false,
+
+	// accessLogLevel level used for the access logs.
+	"accessLogLevel": "info",
+
+	// metrics emit a "$gateway.request" event for each request with the path, method, status,
+	// duration (in milliseconds) and size (in bytes, after compression), to be used by dashboards.
+	"metrics": false,
+
+	// Log the request ctx.params (default to "debug" level, nil to disable)
 	"logRequestParams": "debug",
 
-	// Log the response data (default to disable)
+	// Log the response data at the given level e.g. "info" (default to disable)
 	"logResponseData": nil,
 
 	// If set to true, it will log 4xx client errors, as well
@@ -226,33 +982,101 @@ var defaultSettings = map[string]interface{}{
 	// Use HTTP2 server (experimental)
 	//"http2": false,
 
-	// Optimize route order
+	// Optimize route order, more specific paths are registered first so generic ones
+	// (e.g. with path params) don't shadow them.
 	"optimizeOrder": true,
 
+	// caseInsensitiveRoutes when true the action routes match the path in any case (e.g. /USERS/list).
+	"caseInsensitiveRoutes": false,
+
+	// strictSlash when true requests with or without the trailing slash (e.g. /users/ and /users)
+	// reach the same action, with a redirect to the path of the route.
+	"strictSlash": false,
+
 	//routes
 	"routes": defaultRoutes,
 
+	//assets static files served from folder on path, when the folder exists.
 	"assets": map[string]interface{}{
 		"folder":  "./www",
+		"path":    "/",
 		"options": map[string]interface{}{
 			//options for static module
 		},
+		//spaFallback serve index.html for paths that are not files, for single page apps.
+		"spaFallback": false,
 	},
 }
 
-// populateActionsRouter create a new mux.router
-func populateActionsRouter(context moleculer.Context, settings map[string]interface{}, router *mux.Router) (paths []string) {
+// populateActionsRouter register the action handlers in the router and return them.
+func populateActionsRouter(context moleculer.Context, settings map[string]interface{}, router *mux.Router) []*actionHandler {
 	if router == nil {
-		return paths
+		return nil
+	}
+	handlers := filterActions(context, settings, fetchServices(context))
+	if optimizeOrder, _ := settings["optimizeOrder"].(bool); optimizeOrder {
+		sortBySpecificity(handlers)
 	}
-	for _, actionHand := range filterActions(context, settings, fetchServices(context)) {
+	caseInsensitive, _ := settings["caseInsensitiveRoutes"].(bool)
+	strictSlash, _ := settings["strictSlash"].(bool)
+	for _, actionHand := range handlers {
 		actionHand.context = context
+		actionHand.settings = settings
+		actionHand.acceptedMethodsCache = actionHand.allowedAliasMethods()
 		path := actionHand.pattern()
 		context.Logger().Trace("populateActionsRouter() action -> ", actionHand.action, " path: ", path)
-		router.Handle(path, actionHand)
-		paths = append(paths, path)
+		var handler http.Handler = basicAuthMiddleware(actionHand.route, settings, actionHand)
+		if _, hasCors := actionHand.route["cors"].(map[string]interface{}); hasCors {
+			handler = routeCorsHandler{corsMiddleware(actionHand.route, handler)}
+		}
+		if caseInsensitive {
+			route := router.NewRoute()
+			prefix, _ := route.GetPathTemplate()
+			route.MatcherFunc(caseInsensitiveMatcher(strings.TrimSuffix(prefix, "/")+path, strictSlash)).Handler(handler)
+			continue
+		}
+		router.Handle(path, handler)
+	}
+	return handlers
+}
+
+var pathVariable = regexp.MustCompile(`\{([^}:]+)(?::([^}]+))?\}`)
+
+// caseInsensitiveMatcher return a matcher for the mux path template that ignores the case of the path
+// and sets the path variables, like the mux path matcher does. with strictSlash the trailing slash is optional.
+func caseInsensitiveMatcher(template string, strictSlash bool) mux.MatcherFunc {
+	expression := ""
+	last := 0
+	for _, indexes := range pathVariable.FindAllStringSubmatchIndex(template, -1) {
+		variable := "[^/]+"
+		if indexes[4] >= 0 {
+			variable = template[indexes[4]:indexes[5]]
+		}
+		expression += regexp.QuoteMeta(template[last:indexes[0]]) + "(?P<" + template[indexes[2]:indexes[3]] + ">" + variable + ")"
+		last = indexes[1]
+	}
+	expression += regexp.QuoteMeta(strings.TrimSuffix(template[last:], "/"))
+	if strictSlash {
+		expression += "/?"
+	} else if strings.HasSuffix(template, "/") {
+		expression += "/"
+	}
+	pathRegexp := regexp.MustCompile("(?i)^" + expression + "$")
+	return func(request *http.Request, match *mux.RouteMatch) bool {
+		values := pathRegexp.FindStringSubmatch(request.URL.Path)
+		if values == nil {
+			return false
+		}
+		if match.Vars == nil {
+			match.Vars = map[string]string{}
+		}
+		for index, name := range pathRegexp.SubexpNames() {
+			if name != "" {
+				match.Vars[name] = values[index]
+			}
+		}
+		return true
 	}
-	return paths
 }
 
 // when enable these are the default values
@@ -263,6 +1087,20 @@ var defaultReverseProxy = map[string]interface{}{
 	"target": "http://localhost:3000",
 	//reserse proxy path
 	"targetPath": "/",
+	//path prefixes under targetPath that are not proxied, e.g. []string{"/internal"}.
+	//they are served by the gateway (assets or 404).
+	"proxyExclude": []string{},
+	//max time to connect to the target and to wait for the response headers, the proxy responds
+	//with a JSON 502 Bad Gateway when the target is unreachable and 504 when it times out.
+	"dialTimeout":     30 * time.Second,
+	"responseTimeout": time.Duration(0),
+	//rewrite the path before forwarding: stripPrefix removes a prefix and pattern replaces
+	//the regexp matches with replacement.
+	// "rewrite": map[string]interface{}{
+	// 	"stripPrefix": "/app",
+	// 	"pattern":     "^/v1/(.*)$",
+	// 	"replacement": "/api/v1/$1",
+	// },
 }
 
 type GatewayMixin interface {
@@ -275,14 +1113,35 @@ type HttpService struct {
 	Mixins   []GatewayMixin
 	Deps     []string
 
-	settings      map[string]interface{}
+	settings map[string]interface{}
+
+	// mutex guards handler, server, servers, actionPaths and actionRoutes, accessed from the registry events, Started and Stopped.
+	// servers has one server per address of the listen setting, the first one is also in server.
+	mutex         sync.Mutex
+	handler       http.Handler
 	server        *http.Server
+	servers       []*http.Server
+	customServer  bool
 	router        *mux.Router
-	actionsRouter *mux.Router
+	actionsPrefix string
+	// actionsRouter holds the current *mux.Router with the action routes.
+	// it is swapped on each rebuild, so the server keeps running with in-flight requests untouched.
+	actionsRouter atomic.Value
 	actionPaths   []string
+	actionRoutes  []map[string]interface{}
+
+	rebuildMutex sync.Mutex
+	rebuildTimer *time.Timer
+	// buildMutex serialize the rebuilds of the action routes, so an older snapshot of the registry
+	// never replaces the routes of a newer one.
+	buildMutex sync.Mutex
+
+	// callSlots limit the in-flight action calls to the maxConcurrent setting, shared by all the
+	// action handlers so the limit holds across rebuilds. nil means no limit.
+	callSlots chan bool
 }
 
-func (svc HttpService) Name() string {
+func (svc *HttpService) Name() string {
 	return "api"
 }
 
@@ -291,24 +1150,174 @@ func (svc *HttpService) Dependencies() []string {
 }
 
 // createReverseProxy creates a reverse proxy to serve app UI content for ecample on path X and API (gateway content) on path Y.
+// each proxy settings map a targetPath to a target, the actions are served on the gatewayPath of the first one.
 // used mostly for development.
-func (svc *HttpService) createReverseProxy(proxySettings map[string]interface{}) *mux.Router {
-	gatewayPath := proxySettings["gatewayPath"].(string)
-	target := proxySettings["target"].(string)
-	targetPath := proxySettings["targetPath"].(string)
+func (svc *HttpService) createReverseProxy(proxies []map[string]interface{}, logger *log.Entry) {
+	gatewayPath := proxies[0]["gatewayPath"].(string)
+	logger.Debug("Gateway createReverseProxy() - gatewayPath: ", gatewayPath)
+	svc.handleActions(gatewayPath)
 
-	targetURL, err := url.Parse(target)
-	if err != nil {
-		panic(errors.New(fmt.Sprint("createReverseProxy() parameter target is invalid. It must be a valid URL! - error: ", err.Error())))
+	// longer target paths first, so /admin is not shadowed by /
+	sorted := append([]map[string]interface{}{}, proxies...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i]["targetPath"].(string)) > len(sorted[j]["targetPath"].(string))
+	})
+	for _, proxySettings := range sorted {
+		target := proxySettings["target"].(string)
+		targetPath := proxySettings["targetPath"].(string)
+		targetURL, err := url.Parse(target)
+		if err != nil {
+			panic(errors.New(fmt.Sprint("createReverseProxy() parameter target is invalid. It must be a valid URL! - error: ", err.Error())))
+		}
+		targetProxy := httputil.NewSingleHostReverseProxy(targetURL)
+		targetProxy.Transport = proxyTransport(proxySettings)
+		targetProxy.ErrorHandler = proxyErrorHandler(svc.settings, target, logger)
+		if rewrite := proxyRewrite(proxySettings); rewrite != nil {
+			director := targetProxy.Director
+			targetProxy.Director = func(request *http.Request) {
+				request.URL.Path = rewrite(request.URL.Path)
+				request.URL.RawPath = ""
+				director(request)
+			}
+		}
+		logger.Debug("Gateway createReverseProxy() - targetPath: ", targetPath, " target: ", target)
+		exclude := stringsSetting(proxySettings, "proxyExclude")
+		svc.router.PathPrefix(targetPath).MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+			return !pathExcluded(request.URL.Path, exclude)
+		}).Handler(targetProxy)
+	}
+}
+
+// proxyTransport create the transport of the reverse proxy with the dialTimeout and responseTimeout
+// (time to wait for the response headers) settings. zero means no timeout.
+func proxyTransport(proxySettings map[string]interface{}) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   durationSetting(proxySettings, "dialTimeout"),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ResponseHeaderTimeout: durationSetting(proxySettings, "responseTimeout"),
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// proxyErrorHandler respond with a JSON error when the target can't be reached: 504 when it
+// timed out, otherwise 502.
+func proxyErrorHandler(settings map[string]interface{}, target string, logger *log.Entry) func(http.ResponseWriter, *http.Request, error) {
+	return func(response http.ResponseWriter, request *http.Request, err error) {
+		logger.Error("Gateway reverse proxy error - target: ", target, " path: ", request.URL.Path, " error: ", err)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			sendError(settings, response, http.StatusGatewayTimeout, "Gateway Timeout - target: "+target+" did not respond in time")
+			return
+		}
+		sendError(settings, response, http.StatusBadGateway, "Bad Gateway - target: "+target+" is unreachable")
+	}
+}
+
+// proxyRewrite return the function rewriting the path of the proxied requests from the rewrite settings:
+// stripPrefix removes a prefix (e.g. /app) and pattern replaces the regexp matches with replacement.
+// returns nil when there is no rewrite.
+func proxyRewrite(proxySettings map[string]interface{}) func(string) string {
+	rewrite, exists := proxySettings["rewrite"].(map[string]interface{})
+	if !exists {
+		return nil
+	}
+	stripPrefix, _ := rewrite["stripPrefix"].(string)
+	var pattern *regexp.Regexp
+	if expression, hasPattern := rewrite["pattern"].(string); hasPattern {
+		var err error
+		pattern, err = regexp.Compile(expression)
+		if err != nil {
+			panic(errors.New(fmt.Sprint("createReverseProxy() parameter rewrite.pattern is invalid. It must be a valid regexp! - error: ", err.Error())))
+		}
 	}
-	targetProxy := httputil.NewSingleHostReverseProxy(targetURL)
+	replacement, _ := rewrite["replacement"].(string)
+	return func(requestPath string) string {
+		if stripPrefix != "" && pathExcluded(requestPath, []string{stripPrefix}) {
+			requestPath = "/" + strings.TrimPrefix(strings.TrimPrefix(requestPath, strings.TrimSuffix(stripPrefix, "/")), "/")
+		}
+		if pattern != nil {
+			requestPath = pattern.ReplaceAllString(requestPath, replacement)
+		}
+		return requestPath
+	}
+}
 
-	fmt.Println("createReverseProxy() handle gatewayPath: ", gatewayPath)
-	gatewayRouter := svc.router.PathPrefix(gatewayPath).Subrouter()
+// pathExcluded check if the path is under one of the excluded path prefixes.
+func pathExcluded(requestPath string, exclude []string) bool {
+	for _, prefix := range exclude {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
 
-	fmt.Println("createReverseProxy() handle targetPath: ", targetPath)
-	svc.router.PathPrefix(targetPath).Handler(targetProxy)
-	return gatewayRouter
+// durationSetting return the setting value as a duration. Accepts time.Duration values
+// or strings in the time.ParseDuration format, returns 0 when missing or invalid.
+func durationSetting(settings map[string]interface{}, name string) time.Duration {
+	switch value := settings[name].(type) {
+	case time.Duration:
+		return value
+	case string:
+		duration, err := time.ParseDuration(value)
+		if err == nil {
+			return duration
+		}
+	}
+	return 0
+}
+
+// drainTimeout return the max time to wait for the active connections when stopping.
+func (svc *HttpService) drainTimeout() time.Duration {
+	for _, name := range []string{"shutdownTimeout", "drainTimeout"} {
+		if timeout := durationSetting(svc.settings, name); timeout > 0 {
+			return timeout
+		}
+	}
+	return durationSetting(defaultSettings, "drainTimeout")
+}
+
+// shutdownServer gracefully shuts down the servers, waiting at most the drainTimeout setting
+// for the active connections. the ones still open after the timeout are closed.
+func (svc *HttpService) shutdownServer() error {
+	ctx, cancel := context.WithTimeout(context.Background(), svc.drainTimeout())
+	defer cancel()
+	var result error
+	for _, server := range svc.getServers() {
+		err := server.Shutdown(ctx)
+		if err == context.DeadlineExceeded {
+			if closeErr := server.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// getServers return the servers of the listen addresses, or the single server.
+func (svc *HttpService) getServers() []*http.Server {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+	if len(svc.servers) > 0 {
+		return svc.servers
+	}
+	return []*http.Server{svc.server}
+}
+
+// getServer return the http server, nil before the service is started.
+func (svc *HttpService) getServer() *http.Server {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+	return svc.server
 }
 
 func (svc *HttpService) getAddress() string {
@@ -317,47 +1326,572 @@ func (svc *HttpService) getAddress() string {
 	return fmt.Sprint(ip, ":", port)
 }
 
+// reveserProxy create the reverse proxies from the reverseProxy setting, a map or a list of maps
+// (one per target). without it the actions are served on /.
 func (svc *HttpService) reveserProxy(context moleculer.BrokerContext) {
-	reverseProxy, hasReverseProxy := svc.settings["reverseProxy"].(map[string]interface{})
-	if hasReverseProxy {
-		proxySettings := service.MergeSettings(defaultReverseProxy, reverseProxy)
-		context.Logger().Debug("Gateway resetHandlers() - reverse proxy enabled - proxySettings: ", proxySettings)
-		svc.actionsRouter = svc.createReverseProxy(proxySettings)
-	} else {
-		svc.actionsRouter = svc.router.PathPrefix("/").Subrouter()
+	var reverseProxies []map[string]interface{}
+	switch reverseProxy := svc.settings["reverseProxy"].(type) {
+	case map[string]interface{}:
+		reverseProxies = []map[string]interface{}{reverseProxy}
+	case []map[string]interface{}:
+		reverseProxies = reverseProxy
+	}
+	if len(reverseProxies) == 0 {
+		svc.handleActions("/")
+		return
 	}
+	proxies := []map[string]interface{}{}
+	for _, reverseProxy := range reverseProxies {
+		proxies = append(proxies, service.MergeSettings(defaultReverseProxy, reverseProxy))
+	}
+	context.Logger().Debug("Gateway reveserProxy() - reverse proxy enabled - proxySettings: ", proxies)
+	svc.createReverseProxy(proxies, context.Logger())
+}
+
+// handleActions register the route that dispatches to the current actions router, under the basePath setting.
+// requests that don't match any action fall through to the routes registered after it (e.g. assets).
+func (svc *HttpService) handleActions(prefix string) {
+	if basePath, _ := svc.settings["basePath"].(string); basePath != "" {
+		prefix = path.Join("/", basePath, prefix)
+	}
+	svc.actionsPrefix = prefix
+	svc.router.PathPrefix(prefix).MatcherFunc(svc.matchActions).Handler(http.HandlerFunc(svc.serveActions))
 }
 
+// currentActionsRouter return the current actions router, nil before the first build.
+func (svc *HttpService) currentActionsRouter() *mux.Router {
+	router, _ := svc.actionsRouter.Load().(*mux.Router)
+	return router
+}
+
+// matchActions check if the request matches an action route of the current actions router.
+// before the first build every request under the prefix matches, so it gets the 503 from serveActions.
+func (svc *HttpService) matchActions(request *http.Request, match *mux.RouteMatch) bool {
+	router := svc.currentActionsRouter()
+	return router == nil || router.Match(request, &mux.RouteMatch{})
+}
+
+// serveActions serve the request with the current actions router.
+// responds 503 with Retry-After while the first actions router is being built.
+func (svc *HttpService) serveActions(response http.ResponseWriter, request *http.Request) {
+	router := svc.currentActionsRouter()
+	if router == nil {
+		response.Header().Set("Retry-After", "1")
+		sendError(svc.settings, response, http.StatusServiceUnavailable, "Gateway routes not ready")
+		return
+	}
+	router.ServeHTTP(response, request)
+}
+
+// rebuildActionsRouter build a new router with the routes for the current actions and
+// swap it with the one in use. return the paths of the new routes.
+// the registry is read after taking the buildMutex, so the last rebuild has the latest services.
+func (svc *HttpService) rebuildActionsRouter(context moleculer.Context) []string {
+	svc.buildMutex.Lock()
+	defer svc.buildMutex.Unlock()
+	router := mux.NewRouter()
+	strictSlash, _ := svc.settings["strictSlash"].(bool)
+	router.StrictSlash(strictSlash)
+	handlers := populateActionsRouter(context, svc.settings, router.PathPrefix(svc.actionsPrefix).Subrouter())
+	var paths []string
+	routes := []map[string]interface{}{}
+	for _, handler := range handlers {
+		handler.callSlots = svc.callSlots
+		paths = append(paths, handler.pattern())
+		routes = append(routes, map[string]interface{}{
+			"path":    strings.TrimSuffix(svc.actionsPrefix, "/") + handler.pattern(),
+			"methods": strings.Split(allowHeader(handler.acceptedMethods()), ", "),
+			"action":  handler.action,
+			"route":   handler.routeName,
+		})
+	}
+	svc.actionsRouter.Store(router)
+	svc.mutex.Lock()
+	svc.actionRoutes = routes
+	svc.actionPaths = paths
+	svc.mutex.Unlock()
+	return paths
+}
+
+// wrapHandler apply the middlewares enabled in the settings around the handler.
+func (svc *HttpService) wrapHandler(context moleculer.BrokerContext, handler http.Handler) http.Handler {
+	handler = bearerMiddleware(svc.settings, handler)
+	handler = basicAuthMiddleware(svc.settings, svc.settings, handler)
+	handler = compressionMiddleware(svc.settings, handler)
+	handler = rateLimitMiddleware(svc.settings, handler)
+	handler = svc.corsMiddleware(handler)
+	handler = recoveryMiddleware(svc.settings, context.Logger(), handler)
+	handler = accessLogMiddleware(svc.settings, context.Logger(), handler)
+	return metricsMiddleware(svc.settings, context, handler)
+}
+
+// corsMiddleware apply the global cors settings, except to the action routes with their own cors settings.
+func (svc *HttpService) corsMiddleware(handler http.Handler) http.Handler {
+	globalCors := corsMiddleware(svc.settings, handler)
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if svc.hasRouteCors(request) {
+			handler.ServeHTTP(response, request)
+			return
+		}
+		globalCors.ServeHTTP(response, request)
+	})
+}
+
+// hasRouteCors check if the request matches an action route with its own cors settings.
+func (svc *HttpService) hasRouteCors(request *http.Request) bool {
+	router := svc.currentActionsRouter()
+	if router == nil {
+		return false
+	}
+	var match mux.RouteMatch
+	if !router.Match(request, &match) {
+		return false
+	}
+	_, hasCors := match.Handler.(routeCorsHandler)
+	return hasCors
+}
+
+// serveHealth register the health check endpoint on the healthPath setting, outside of the
+// action routing. an empty path disables it. it responds 503 while requiredServices are missing.
+func (svc *HttpService) serveHealth(context moleculer.BrokerContext) {
+	path, _ := svc.settings["healthPath"].(string)
+	if path == "" {
+		return
+	}
+	started := time.Now()
+	context.Logger().Debug("Gateway serveHealth() - path: ", path)
+	required := stringsSetting(svc.settings, "requiredServices")
+	svc.router.Path(path).Methods(http.MethodGet, http.MethodHead).HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if len(required) > 0 {
+			if missing := missingServices(fetchServices(context.(moleculer.Context)), required); len(missing) > 0 {
+				sendJSON(response, http.StatusServiceUnavailable, map[string]interface{}{
+					"status":  "not ready",
+					"missing": missing,
+				})
+				return
+			}
+		}
+		sendJSON(response, http.StatusOK, map[string]interface{}{
+			"status":  "ok",
+			"uptime":  int64(time.Since(started).Seconds()),
+			"actions": len(svc.ActionPaths()),
+		})
+	})
+}
+
+// missingServices return the required services that are not in the list of services.
+func missingServices(services []map[string]interface{}, required []string) []string {
+	available := map[string]bool{}
+	for _, service := range services {
+		if name, ok := service["name"].(string); ok {
+			available[name] = true
+		}
+	}
+	missing := []string{}
+	for _, name := range required {
+		if !available[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// serveRoutes register the endpoint listing the action routes on the routesPath setting, with the
+// path, methods, action and route name of each one. an empty path disables it.
+func (svc *HttpService) serveRoutes(context moleculer.BrokerContext) {
+	path, _ := svc.settings["routesPath"].(string)
+	if path == "" {
+		return
+	}
+	context.Logger().Debug("Gateway serveRoutes() - path: ", path)
+	svc.router.Path(path).Methods(http.MethodGet, http.MethodHead).HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		svc.mutex.Lock()
+		routes := svc.actionRoutes
+		svc.mutex.Unlock()
+		sendJSON(response, http.StatusOK, routes)
+	})
+}
+
+// openAPIPath convert the mux path pattern into an OpenAPI path, removing the regexp of the
+// path params (e.g. /users/{id:[0-9]+} -> /users/{id}), and return the names of the params.
+func openAPIPath(pattern string) (string, []string) {
+	names := []string{}
+	segments := strings.Split(pattern, "/")
+	for index, segment := range segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			name := strings.SplitN(strings.Trim(segment, "{}"), ":", 2)[0]
+			names = append(names, name)
+			segments[index] = "{" + name + "}"
+		}
+	}
+	return strings.Join(segments, "/"), names
+}
+
+// openAPISchema return the schema of the action params, declared as a type name (e.g. "string")
+// or a map with a "type" (e.g. {"type": "number"}). other declarations are left without a type.
+func openAPISchema(params map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for name, param := range params {
+		property := map[string]interface{}{}
+		switch param := param.(type) {
+		case string:
+			property["type"] = param
+		case map[string]interface{}:
+			if paramType, exists := param["type"].(string); exists {
+				property["type"] = paramType
+			}
+		}
+		properties[name] = property
+	}
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// openAPIDocument generate a minimal OpenAPI document with an operation per method of the action
+// routes, using the params declared by the actions in the services list for the request body.
+func openAPIDocument(services []map[string]interface{}, routes []map[string]interface{}) map[string]interface{} {
+	actionServices := map[string]interface{}{}
+	actionParams := map[string]map[string]interface{}{}
+	for _, service := range services {
+		serviceActions, _ := service["actions"].(map[string]map[string]interface{})
+		for _, action := range serviceActions {
+			name, _ := action["name"].(string)
+			actionServices[name] = service["name"]
+			actionParams[name], _ = action["params"].(map[string]interface{})
+		}
+	}
+	paths := map[string]interface{}{}
+	for _, route := range routes {
+		action, _ := route["action"].(string)
+		path, pathParams := openAPIPath(route["path"].(string))
+		item, exists := paths[path].(map[string]interface{})
+		if !exists {
+			item = map[string]interface{}{}
+			paths[path] = item
+		}
+		for _, method := range route["methods"].([]string) {
+			if method == http.MethodHead || method == http.MethodOptions {
+				continue
+			}
+			parameters := []interface{}{}
+			for _, name := range pathParams {
+				parameters = append(parameters, map[string]interface{}{
+					"name": name, "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+				})
+			}
+			operation := map[string]interface{}{
+				"operationId": action,
+				"parameters":  parameters,
+				"responses":   map[string]interface{}{"200": map[string]interface{}{"description": "Success"}},
+			}
+			if service, exists := actionServices[action]; exists {
+				operation["tags"] = []interface{}{service}
+			}
+			if method != http.MethodGet && method != http.MethodDelete {
+				operation["requestBody"] = map[string]interface{}{"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": openAPISchema(actionParams[action])},
+				}}
+			}
+			item[strings.ToLower(method)] = operation
+		}
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info":    map[string]interface{}{"title": "Moleculer API Gateway", "version": "1.0.0"},
+		"paths":   paths,
+	}
+}
+
+// serveOpenAPI register the endpoint with the OpenAPI document of the action routes on the
+// openapiPath setting. the document is generated on each request, so it follows the registry changes.
+func (svc *HttpService) serveOpenAPI(context moleculer.BrokerContext) {
+	path, _ := svc.settings["openapiPath"].(string)
+	if path == "" {
+		return
+	}
+	context.Logger().Debug("Gateway serveOpenAPI() - path: ", path)
+	svc.router.Path(path).Methods(http.MethodGet, http.MethodHead).HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		svc.mutex.Lock()
+		routes := svc.actionRoutes
+		svc.mutex.Unlock()
+		sendJSON(response, http.StatusOK, openAPIDocument(fetchServices(context.(moleculer.Context)), routes))
+	})
+}
+
+// serveAssets register a file server for the assets folder, when the folder exists.
+// it must be called after the actions router is created, so action routes take precedence.
+func (svc *HttpService) serveAssets(context moleculer.BrokerContext) {
+	assets, exists := svc.settings["assets"].(map[string]interface{})
+	if !exists {
+		return
+	}
+	folder, _ := assets["folder"].(string)
+	if info, err := os.Stat(folder); err != nil || !info.IsDir() {
+		context.Logger().Debug("Gateway serveAssets() - assets folder not found: ", folder)
+		return
+	}
+	path, _ := assets["path"].(string)
+	if path == "" {
+		path = "/"
+	}
+	context.Logger().Debug("Gateway serveAssets() - serving folder: ", folder, " on path: ", path)
+	var fileServer http.Handler = http.FileServer(http.Dir(folder))
+	if spaFallback, _ := assets["spaFallback"].(bool); spaFallback {
+		fileServer = spaFallbackHandler(folder, fileServer)
+	}
+	svc.router.PathPrefix(path).Handler(http.StripPrefix(strings.TrimSuffix(path, "/"), fileServer))
+}
+
+// spaFallbackHandler serve the index.html of the folder for GET requests to paths that are not
+// files (e.g. /users/42), so the client side routing of single page apps works.
+// missing files with an extension (e.g. /app.js) still get a 404.
+func spaFallbackHandler(folder string, fileServer http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == http.MethodGet || request.Method == http.MethodHead {
+			name := filepath.Join(folder, filepath.FromSlash(path.Clean("/"+request.URL.Path)))
+			if _, err := os.Stat(name); os.IsNotExist(err) && path.Ext(request.URL.Path) == "" {
+				http.ServeFile(response, request, filepath.Join(folder, "index.html"))
+				return
+			}
+		}
+		fileServer.ServeHTTP(response, request)
+	})
+}
+
+// notFoundHandler return the handler for requests that don't match any route. the "notFoundHandler"
+// setting replaces the default, which responds 404 with the JSON error payload.
+func notFoundHandler(settings map[string]interface{}, logger *log.Entry) http.Handler {
+	if handler, exists := settings["notFoundHandler"].(http.Handler); exists {
+		return handler
+	}
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		logger.Debug("Gateway notFoundHandler() - no route for path: ", request.URL.Path)
+		notFound := statusError{"Not Found - path: " + request.URL.Path, http.StatusNotFound}
+		(&actionHandler{settings: settings}).sendReponse(logger, request, payload.New(notFound), response)
+	})
+}
+
+// routeMethods return the methods accepted by the router for the request path.
+func routeMethods(router *mux.Router, request *http.Request) []string {
+	methods := []string{}
+	candidates := append([]string{http.MethodHead, http.MethodOptions}, validMethods...)
+	for _, method := range candidates {
+		probe := *request
+		probe.Method = method
+		match := &mux.RouteMatch{}
+		if router.Match(&probe, match) && match.MatchErr == nil {
+			methods = append(methods, method)
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// methodNotAllowedHandler respond 405 with the Allow header and the JSON error payload when the
+// path matches a route registered for other methods.
+func methodNotAllowedHandler(router *mux.Router, settings map[string]interface{}, logger *log.Entry) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		allowed := strings.Join(routeMethods(router, request), ", ")
+		logger.Debug("Gateway methodNotAllowedHandler() - method: ", request.Method, " path: ", request.URL.Path, " allowed: ", allowed)
+		response.Header().Set("Allow", allowed)
+		notAllowed := statusError{"Invalid HTTP Method - accepted methods: " + allowed, http.StatusMethodNotAllowed}
+		(&actionHandler{settings: settings}).sendReponse(logger, request, payload.New(notAllowed), response)
+	})
+}
+
+// newServer create the http server with the timeouts and maxHeaderBytes from settings.
+func newServer(settings map[string]interface{}, address string, handler http.Handler) *http.Server {
+	maxHeaderBytes, _ := settings["maxHeaderBytes"].(int)
+	return &http.Server{
+		Addr:           address,
+		Handler:        handler,
+		ReadTimeout:    durationSetting(settings, "readTimeout"),
+		WriteTimeout:   durationSetting(settings, "writeTimeout"),
+		IdleTimeout:    durationSetting(settings, "idleTimeout"),
+		MaxHeaderBytes: maxHeaderBytes,
+	}
+}
+
+// tlsFiles return the certificate and key files from the tls settings.
+func (svc *HttpService) tlsFiles() (string, string) {
+	tlsSettings, exists := svc.settings["tls"].(map[string]interface{})
+	if !exists {
+		return "", ""
+	}
+	certFile, _ := tlsSettings["certFile"].(string)
+	keyFile, _ := tlsSettings["keyFile"].(string)
+	return certFile, keyFile
+}
+
+// listenAddress return the network and address the server listens on.
+// for the unix network the address is the socket setting.
+func (svc *HttpService) listenAddress() (string, string) {
+	network, exists := svc.settings["network"].(string)
+	if !exists || network == "" {
+		network = "tcp"
+	}
+	if network == "unix" {
+		socket, _ := svc.settings["socket"].(string)
+		return network, socket
+	}
+	return network, svc.getAddress()
+}
+
+// createListener return the listener from the "listener" setting, or listen on the configured address.
+func (svc *HttpService) createListener() (net.Listener, string, string, error) {
+	if listener, exists := svc.settings["listener"].(net.Listener); exists {
+		return listener, listener.Addr().Network(), listener.Addr().String(), nil
+	}
+	network, address := svc.listenAddress()
+	listener, err := net.Listen(network, address)
+	return listener, network, address, err
+}
+
+// startServer creates the listener and serves the requests with the server until it is shutdown.
 func (svc *HttpService) startServer(context moleculer.BrokerContext) {
-	address := svc.getAddress()
-	context.Logger().Info("Server starting to listen on: ", address)
-	err := svc.server.ListenAndServe()
+	listener, network, address, err := svc.createListener()
+	if err != nil {
+		context.Logger().Error("Error listening server on: ", address, " network: ", network, " error: ", err)
+		return
+	}
+	svc.serve(context, svc.getServer(), listener, network, address)
+}
+
+// startServers start one server per address of the listen setting, all with the same handler,
+// listening on the network setting. for the unix network the addresses are socket paths.
+func (svc *HttpService) startServers(context moleculer.BrokerContext, addresses []string, handler http.Handler) {
+	network, _ := svc.listenAddress()
+	servers := make([]*http.Server, len(addresses))
+	for index, address := range addresses {
+		servers[index] = newServer(svc.settings, address, handler)
+	}
+	svc.mutex.Lock()
+	svc.server = servers[0]
+	svc.servers = servers
+	svc.mutex.Unlock()
+	for _, server := range servers {
+		go func(server *http.Server) {
+			listener, err := net.Listen(network, server.Addr)
+			if err != nil {
+				context.Logger().Error("Error listening server on: ", server.Addr, " network: ", network, " error: ", err)
+				return
+			}
+			svc.serve(context, server, listener, network, server.Addr)
+		}(server)
+	}
+}
+
+// serve emits the "$gateway.listening" event with the bound address and serves the requests
+// from the listener until the server is shutdown.
+func (svc *HttpService) serve(context moleculer.BrokerContext, server *http.Server, listener net.Listener, network, address string) {
+	context.Emit("$gateway.listening", map[string]interface{}{
+		"network": network,
+		"address": listener.Addr().String(),
+	})
+	var err error
+	certFile, keyFile := svc.tlsFiles()
+	if certFile != "" && keyFile != "" {
+		context.Logger().Info("Server starting to listen with TLS on: ", address, " network: ", network)
+		err = server.ServeTLS(listener, certFile, keyFile)
+	} else {
+		context.Logger().Info("Server starting to listen on: ", address, " network: ", network)
+		err = server.Serve(listener)
+	}
 	if err != nil && err.Error() != "http: Server closed" {
 		context.Logger().Error("Error listening server on: ", address, " error: ", err)
 	}
 	context.Logger().Info("Server stopped -> address: ", address)
 }
 
-// Started httpService started. It process the settings (default + params), starts a http server,
-// notify the plugins that the http server is starting.
-func (svc *HttpService) Started(context moleculer.BrokerContext, schema moleculer.ServiceSchema) {
-	svc.settings = service.MergeSettings(defaultSettings, schema.Settings, svc.Settings)
-	address := svc.getAddress()
-	svc.server = &http.Server{Addr: address}
+// buildRouter create the router with the mixins, reverse proxy and assets routes and return it
+// wrapped with the middlewares. the action routes are added later by rebuildActionsRouter.
+func (svc *HttpService) buildRouter(context moleculer.BrokerContext) http.Handler {
 	svc.router = mux.NewRouter()
-	svc.server.Handler = svc.router
+	svc.router.NotFoundHandler = notFoundHandler(svc.settings, context.Logger())
+	svc.router.MethodNotAllowedHandler = methodNotAllowedHandler(svc.router, svc.settings, context.Logger())
 	for _, mixin := range svc.Mixins {
 		mixin.RouterStarting(context, svc.router)
 	}
+	svc.serveHealth(context)
+	svc.serveRoutes(context)
+	svc.serveOpenAPI(context)
 	svc.reveserProxy(context)
-	go svc.startServer(context)
-	go populateActionsRouter(context.(moleculer.Context), svc.settings, svc.actionsRouter)
+	svc.serveAssets(context)
+	return svc.wrapHandler(context, svc.router)
+}
+
+// serviceHandler serve the requests with the handler of the gateway service, so it can be mounted
+// in other routers (see Handler). it is not a method of HttpService, since public methods become actions.
+type serviceHandler struct {
+	svc *HttpService
+}
+
+// ServeHTTP responds 503 until the service is started.
+func (h serviceHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	h.svc.mutex.Lock()
+	handler := h.svc.handler
+	h.svc.mutex.Unlock()
+	if handler == nil {
+		sendError(h.svc.Settings, response, http.StatusServiceUnavailable, "Gateway not started")
+		return
+	}
+	handler.ServeHTTP(response, request)
+}
+
+// Handler publish the gateway service in the broker in middleware mode (without a server) and
+// return it as an http.Handler to be mounted in another router. the action routes are rebuilt
+// on the registry events, like when the gateway owns the server.
+func Handler(bkr *broker.ServiceBroker, settings map[string]interface{}) (http.Handler, error) {
+	if bkr == nil {
+		return nil, errors.New("Handler() requires a broker to publish the gateway service")
+	}
+	svc := &HttpService{Settings: service.MergeSettings(settings, map[string]interface{}{"server": false})}
+	bkr.Publish(svc)
+	return serviceHandler{svc}, nil
+}
+
+// Started httpService started. It process the settings (default + params), starts a http server,
+// notify the plugins that the http server is starting.
+func (svc *HttpService) Started(context moleculer.BrokerContext, schema moleculer.ServiceSchema) {
+	svc.settings = service.MergeSettings(defaultSettings, schema.Settings, svc.Settings)
+	if maxConcurrent, _ := svc.settings["maxConcurrent"].(int); maxConcurrent > 0 {
+		svc.callSlots = make(chan bool, maxConcurrent)
+	}
+	handler := svc.buildRouter(context)
+	svc.mutex.Lock()
+	svc.handler = handler
+	svc.mutex.Unlock()
+	addresses, _ := svc.settings["listen"].([]string)
+	if enabled, isBool := svc.settings["server"].(bool); isBool && !enabled {
+		context.Logger().Info("Gateway in middleware mode, no server started")
+	} else if len(addresses) > 0 {
+		svc.startServers(context, addresses, handler)
+	} else {
+		server, customServer := svc.settings["server"].(*http.Server)
+		if customServer {
+			server.Handler = handler
+		} else {
+			server = newServer(svc.settings, svc.getAddress(), handler)
+		}
+		svc.mutex.Lock()
+		svc.server = server
+		svc.customServer = customServer
+		svc.mutex.Unlock()
+		if !customServer {
+			go svc.startServer(context)
+		}
+	}
+	go svc.rebuildActionsRouter(context.(moleculer.Context))
 	context.Logger().Info("Gateway Started()")
 }
 
+// Stopped shutdown the http server. a server provided in the settings is left running,
+// since its lifecycle is managed by who created it.
 func (svc *HttpService) Stopped(context moleculer.BrokerContext, schema moleculer.ServiceSchema) {
-	if svc.server != nil {
-		err := svc.server.Shutdown(nil)
+	svc.mutex.Lock()
+	customServer := svc.customServer
+	svc.mutex.Unlock()
+	if svc.getServer() != nil && !customServer {
+		err := svc.shutdownServer()
 		if err != nil {
 			context.Logger().Error("Error shutting down server - error: ", err)
 		}
@@ -365,18 +1899,53 @@ func (svc *HttpService) Stopped(context moleculer.BrokerContext, schema molecule
 	context.Logger().Info("Gateway stopped()")
 }
 
-// serviceAdded method used to handle the service added event
-func (svc *HttpService) serviceAdded(context moleculer.Context, params moleculer.Payload) {
-	if svc.actionsRouter == nil {
+// servicesChanged handle the service added and removed events, rebuilding the action routes.
+// events received before Started has built the router are ignored, Started builds the routes.
+func (svc *HttpService) servicesChanged(context moleculer.Context, params moleculer.Payload) {
+	if !svc.started() {
+		return
+	}
+	svc.scheduleRebuild(context)
+}
+
+// started check if Started has built the router. the handler is set under the mutex after the
+// settings and the router, so reading them after this check is safe.
+func (svc *HttpService) started() bool {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+	return svc.handler != nil
+}
+
+// scheduleRebuild rebuild the action routes after the rebuildDebounce window. events received
+// within the window restart it, so a burst of registry events results in a single rebuild.
+func (svc *HttpService) scheduleRebuild(context moleculer.Context) {
+	rebuild := func() {
+		svc.rebuildActionsRouter(context)
+	}
+	debounce := durationSetting(svc.settings, "rebuildDebounce")
+	if debounce <= 0 {
+		go rebuild()
 		return
 	}
-	go func() {
-		paths := populateActionsRouter(context, svc.settings, svc.actionsRouter)
-		svc.actionPaths = paths
-	}()
+	svc.rebuildMutex.Lock()
+	defer svc.rebuildMutex.Unlock()
+	if svc.rebuildTimer != nil {
+		svc.rebuildTimer.Stop()
+	}
+	svc.rebuildTimer = time.AfterFunc(debounce, rebuild)
 }
 
+// setActionPaths update the paths of the current action routes.
+func (svc *HttpService) setActionPaths(paths []string) {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+	svc.actionPaths = paths
+}
+
+// ActionPaths return the paths of the current action routes.
 func (svc *HttpService) ActionPaths() []string {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
 	return svc.actionPaths
 }
 
@@ -384,7 +1953,11 @@ func (svc *HttpService) Events() []moleculer.Event {
 	return []moleculer.Event{
 		{
 			Name:    "$registry.service.added",
-			Handler: svc.serviceAdded,
+			Handler: svc.servicesChanged,
+		},
+		{
+			Name:    "$registry.service.removed",
+			Handler: svc.servicesChanged,
 		},
 	}
 }
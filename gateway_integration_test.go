@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"time"
 
 	"github.com/moleculer-go/gateway"
@@ -122,15 +123,54 @@ var _ = Describe("API Gateway Integration Tests", func() {
 			gatewayBkr.Start()
 			gatewayBkr.WaitForNodes("node_printerBroker")
 
-			response, err := http.Get("http://localhost:3552/printer/print?content=Hellow%20World")
-			Expect(err).Should(BeNil())
+			<-waitAction("/printer/print", gatewaySvc)
+			var response *http.Response
+			Eventually(func() error {
+				var err error
+				response, err = http.Get("http://localhost:3552/printer/print?content=Hellow%20World")
+				return err
+			}).Should(BeNil())
 			Expect(bodyContent(response)).Should(Equal("printed content: Hellow World"))
 
 			servicesBkr.Stop()
 			gatewayBkr.Stop()
 		})
 
-		It("should discover new added service, reject call when service is removed, and accept again when service added", func(done Done) {
+		It("should serve the actions through the handler returned by gateway.Handler", func() {
+			mem := &memory.SharedMemory{}
+			servicesBkr := createPrinterBroker(mem)
+			gatewayBkr := createGatewayBroker(mem)
+			handler, err := gateway.Handler(gatewayBkr, map[string]interface{}{})
+			Expect(err).Should(Succeed())
+
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			response, err := http.Get(server.URL + "/printer/print?content=Hello")
+			Expect(err).Should(Succeed())
+			Expect(response.StatusCode).Should(Equal(http.StatusServiceUnavailable))
+
+			servicesBkr.Start()
+			gatewayBkr.Start()
+			gatewayBkr.WaitForNodes("node_printerBroker")
+			Eventually(func() string {
+				response, err := http.Get(server.URL + "/printer/print?content=Hello")
+				if err != nil {
+					return err.Error()
+				}
+				return bodyContent(response)
+			}).Should(Equal("printed content: Hello"))
+
+			servicesBkr.Stop()
+			gatewayBkr.Stop()
+		})
+
+		It("should return an error from gateway.Handler without a broker", func() {
+			handler, err := gateway.Handler(nil, map[string]interface{}{})
+			Expect(err).Should(HaveOccurred())
+			Expect(handler).Should(BeNil())
+		})
+
+		It("should discover new added service, drop its route when service is removed, and accept again when service added", func(done Done) {
 			mem := &memory.SharedMemory{}
 			servicesBkr := createPrinterBroker(mem)
 			gatewayBkr := createGatewayBroker(mem)
@@ -149,14 +189,19 @@ var _ = Describe("API Gateway Integration Tests", func() {
 			gatewayBkr.WaitFor("printer")
 			gatewayBkr.WaitForNodes("node_printerBroker")
 
-			response, err := http.Get(host + "/printer/print?content=Hellow-World")
-			Expect(err).Should(Succeed())
+			<-waitAction("/printer/print", gatewaySvc)
+			var response *http.Response
+			var err error
+			Eventually(func() error {
+				response, err = http.Get(host + "/printer/print?content=Hellow-World")
+				return err
+			}).Should(Succeed())
 			Expect(bodyContent(response)).Should(Equal("printed content: Hellow-World"))
 
 			tempBkr := createTempBroker(mem, "stuffed")
 			tempBkr.Start()
 			gatewayBkr.WaitForActions("temp.stuff")
-			time.Sleep(time.Millisecond)
+			<-waitAction("/temp/stuff", gatewaySvc)
 			response, err = http.Get(host + "/temp/stuff?content=Brave-New-World")
 			Expect(err).Should(Succeed())
 			Expect(bodyContent(response)).Should(Equal("Brave-New-World stuffed..."))
@@ -170,18 +215,19 @@ var _ = Describe("API Gateway Integration Tests", func() {
 				}
 				time.Sleep(time.Microsecond)
 			}
+			Eventually(gatewaySvc.ActionPaths).ShouldNot(ContainElement("/temp/stuff"))
 			response, err = http.Get(host + "/temp/stuff?content=HellowWorld")
 			Expect(err).Should(Succeed())
-			Expect(response.StatusCode).Should(Equal(500))
+			Expect(response.StatusCode).Should(Equal(404))
 			bc := bodyContent(response)
 			fmt.Println(bc)
-			Expect(bc).Should(Equal(`{"error":"Registry - endpoint not found for actionName: temp.stuff"}`))
+			Expect(bc).Should(Equal(`{"code":404,"error":"Not Found - path: /temp/stuff","name":"NotFoundError"}`))
 
 			//start it again with modified service
 			tempBkr = createTempBroker(mem, "reborn")
 			tempBkr.Start()
 			gatewayBkr.WaitForActions("temp.stuff")
-			gatewayBkr.WaitForActions("temp.stuff")
+			<-waitAction("/temp/stuff", gatewaySvc)
 			response, err = http.Get(host + "/temp/stuff?content=Me-Again")
 			Expect(err).Should(Succeed())
 			Expect(bodyContent(response)).Should(Equal("Me-Again reborn..."))
@@ -1,18 +1,45 @@
 package gateway
 
 import (
+	"bufio"
+	"bytes"
+	stdcontext "context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"encoding/xml"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/moleculer-go/moleculer"
 	"github.com/moleculer-go/moleculer/context"
 	"github.com/moleculer-go/moleculer/test"
 
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/tidwall/gjson"
+	"github.com/vmihailenco/msgpack"
 
 	"github.com/moleculer-go/moleculer/payload"
 
@@ -101,6 +128,64 @@ var _ = Describe("API Gateway", func() {
 			Expect(actionHandlers[3].pattern()).Should(Equal("/user/update"))
 		})
 
+		It("should skip the routes that are not enabled", func() {
+			debugEnabled := false
+			settings := map[string]interface{}{
+				"routes": []map[string]interface{}{
+					{"path": "/api", "whitelist": []string{"user.*"}, "enabled": true},
+					{"path": "/debug", "whitelist": []string{"auth.*"}, "enabled": false},
+					{"path": "/dev", "whitelist": []string{"auth.login"}, "enabled": func() bool { return debugEnabled }},
+				},
+			}
+			actionHandlers := filterActions(ctx, settings, services)
+			sort.Sort(handlerSorter{actionHandlers})
+			paths := []string{}
+			for _, handler := range actionHandlers {
+				paths = append(paths, handler.pattern())
+			}
+			Expect(paths).Should(Equal([]string{"/api/user/list", "/api/user/update"}))
+
+			debugEnabled = true
+			Expect(filterActions(ctx, settings, services)).Should(HaveLen(3))
+		})
+
+		It("should build the paths with the pathMapper from settings or route", func() {
+			kebabCase := func(action string) string {
+				path := ""
+				for _, char := range action {
+					switch {
+					case char == '.':
+						path += "/"
+					case char >= 'A' && char <= 'Z':
+						path += "-" + strings.ToLower(string(char))
+					default:
+						path += string(char)
+					}
+				}
+				return path
+			}
+			services := []map[string]interface{}{{"name": "userProfile", "actions": map[string]map[string]interface{}{
+				"getAvatar": {"name": "userProfile.getAvatar"},
+			}}}
+			settings := map[string]interface{}{
+				"pathMapper": kebabCase,
+				"routes": []map[string]interface{}{
+					{"path": "/api"},
+					{"path": "/raw", "pathMapper": func(action string) string { return action }},
+					{"path": "/alias", "aliases": map[string]string{"GET avatar": "userProfile.getAvatar"}},
+				},
+			}
+			paths := []string{}
+			for _, handler := range filterActions(ctx, settings, services) {
+				paths = append(paths, handler.pattern())
+			}
+			sort.Strings(paths)
+			Expect(paths).Should(Equal([]string{"/alias/avatar", "/api/user-profile/get-avatar", "/raw/userProfile.getAvatar"}))
+
+			handlers := filterActions(ctx, map[string]interface{}{"routes": []map[string]interface{}{{"path": "/"}}}, services)
+			Expect(handlers[0].pattern()).Should(Equal("/userProfile/getAvatar"))
+		})
+
 		It("should filter actions using whitelist settings", func() {
 			settings := map[string]interface{}{
 				"routes": []map[string]interface{}{
@@ -129,6 +214,50 @@ var _ = Describe("API Gateway", func() {
 			Expect(patterns).Should(ContainSubstring("/user/update"))
 		})
 
+		It("should remove the blacklisted actions after the whitelist", func() {
+			settings := map[string]interface{}{
+				"routes": []map[string]interface{}{
+					{
+						"path":      "/",
+						"whitelist": []string{"**"},
+						"blacklist": []string{"user.update", "*.logout"},
+					},
+				},
+			}
+			actionHandlers := filterActions(ctx, settings, services)
+			Expect(len(actionHandlers)).Should(Equal(2))
+			sort.Sort(handlerSorter{actionHandlers})
+			Expect(actionHandlers[0].pattern()).Should(Equal("/auth/login"))
+			Expect(actionHandlers[1].pattern()).Should(Equal("/user/list"))
+		})
+
+		It("should expand the children routes inheriting the parent settings", func() {
+			settings := map[string]interface{}{
+				"routes": []map[string]interface{}{
+					{
+						"path":            "/",
+						"whitelist":       []string{"user.*"},
+						"responseHeaders": map[string]string{"X-Group": "users"},
+						"children": []map[string]interface{}{
+							{"path": "/v1"},
+							{"path": "/v2", "whitelist": []string{"auth.login"}},
+							{"children": []map[string]interface{}{{"path": "/v3"}}},
+						},
+					},
+				},
+			}
+			actionHandlers := filterActions(ctx, settings, services)
+			Expect(len(actionHandlers)).Should(Equal(5))
+			sort.Sort(handlerSorter{actionHandlers})
+			Expect(actionHandlers[0].pattern()).Should(Equal("/v1/user/list"))
+			Expect(actionHandlers[1].pattern()).Should(Equal("/v1/user/update"))
+			Expect(actionHandlers[2].pattern()).Should(Equal("/v2/auth/login"))
+			Expect(actionHandlers[3].pattern()).Should(Equal("/v3/user/list"))
+			Expect(actionHandlers[4].pattern()).Should(Equal("/v3/user/update"))
+			Expect(actionHandlers[0].route["responseHeaders"]).Should(Equal(map[string]string{"X-Group": "users"}))
+			Expect(actionHandlers[0].route).ShouldNot(HaveKey("children"))
+		})
+
 		It("should handle multiple routes", func() {
 			settings := map[string]interface{}{
 				"routes": []map[string]interface{}{
@@ -173,232 +302,3263 @@ var _ = Describe("API Gateway", func() {
 		})
 	})
 
-	Describe("sendReponse", func() {
-		It("should convert result into JSON and send in the reponse with success status code", func() {
-			result := map[string]interface{}{
-				"name":     "John",
-				"lastName": "Snow",
-				"category": "Bastart",
-				"nilvalue": nil,
-			}
+	Describe("Stopped", func() {
+		bkrContext := context.BrokerContext(test.DelegatesWithIdAndConfig(
+			"nodeID",
+			moleculer.Config{},
+		))
 
-			response := &mockReponseWriter{header: map[string][]string{}}
-			ah := actionHandler{}
-			ah.sendReponse(log.WithField("test", ""), payload.New(result), response)
-			json := response.String()
-			Expect(gjson.Get(json, "category").String()).Should(Equal("Bastart"))
-			Expect(gjson.Get(json, "lastName").String()).Should(Equal("Snow"))
-			Expect(gjson.Get(json, "name").String()).Should(Equal("John"))
+		It("should shutdown the server without panicking", func() {
+			svc := &HttpService{
+				settings: map[string]interface{}{"shutdownTimeout": time.Second},
+				server:   &http.Server{Addr: "localhost:3561"},
+			}
+			go svc.server.ListenAndServe()
+			time.Sleep(time.Millisecond * 10)
+			Expect(func() {
+				svc.Stopped(bkrContext, moleculer.ServiceSchema{})
+			}).ShouldNot(Panic())
+			_, err := http.Get("http://localhost:3561/")
+			Expect(err).ShouldNot(BeNil())
+		})
 
-			Expect(response.statusCode).Should(Equal(succesStatusCode))
-			Expect(response.Header().Get("Content-Type")).Should(Equal("application/json"))
+		It("should close the connections still open after the drainTimeout", func() {
+			release := make(chan bool)
+			defer close(release)
+			started := make(chan bool, 1)
+			svc := &HttpService{
+				settings: map[string]interface{}{"drainTimeout": 100 * time.Millisecond},
+				server: &http.Server{Addr: "localhost:3570", Handler: http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+					started <- true
+					<-release
+				})},
+			}
+			go svc.server.ListenAndServe()
+			slowErr := make(chan error, 1)
+			Eventually(func() error {
+				connection, err := net.Dial("tcp", "localhost:3570")
+				if err == nil {
+					connection.Close()
+				}
+				return err
+			}).Should(Succeed())
+			go func() {
+				_, err := http.Get("http://localhost:3570/slow")
+				slowErr <- err
+			}()
+			Eventually(started).Should(Receive())
+
+			start := time.Now()
+			svc.Stopped(bkrContext, moleculer.ServiceSchema{})
+			Expect(time.Since(start)).Should(BeNumerically("<", time.Second))
+			Eventually(slowErr).Should(Receive(HaveOccurred()))
 		})
 
-		It("should convert error result into JSON and send in the reponse with error status code", func() {
-			response := &mockReponseWriter{header: map[string][]string{}}
-			ah := actionHandler{}
-			ah.sendReponse(log.WithField("test", ""), payload.New(errors.New("Some error...")), response)
-			json := response.String()
-			Expect(gjson.Get(json, "error").String()).Should(Equal("Some error..."))
-			Expect(response.statusCode).Should(Equal(errorStatusCode))
-			Expect(response.Header().Get("Content-Type")).Should(Equal("application/json"))
+		It("should fallback to the default shutdown timeout", func() {
+			svc := &HttpService{server: &http.Server{Addr: "localhost:3562"}}
+			Expect(func() {
+				svc.Stopped(bkrContext, moleculer.ServiceSchema{})
+			}).ShouldNot(Panic())
 		})
 	})
 
-	Describe("paramsFromRequest", func() {
+	Describe("serveAssets", func() {
+		bkrContext := context.BrokerContext(test.DelegatesWithIdAndConfig(
+			"nodeID",
+			moleculer.Config{},
+		))
+		var folder string
 
-		It("should get params from the URL", func() {
-			parsedUrl, _ := url.Parse("http://local/path?force=false&name=John&actions=first&actions=second")
-			request := &http.Request{
-				URL: parsedUrl,
+		BeforeEach(func() {
+			var err error
+			folder, err = ioutil.TempDir("", "gateway-assets")
+			Expect(err).Should(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(folder, "index.html"), []byte("<h1>Hello</h1>"), 0644)).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(folder)
+		})
+
+		assetsService := func(assets map[string]interface{}) *HttpService {
+			svc := &HttpService{
+				settings: map[string]interface{}{"assets": assets},
+				router:   mux.NewRouter(),
 			}
+			svc.reveserProxy(bkrContext)
+			actions := mux.NewRouter()
+			actions.Handle("/user/list", okHandler)
+			svc.actionsRouter.Store(actions)
+			svc.serveAssets(bkrContext)
+			return svc
+		}
 
-			payload := paramsFromRequest(request, log.WithField("unit", "test"))
-			Expect(payload.Get("force").Exists()).Should(BeTrue())
-			Expect(payload.Get("force").Bool()).Should(BeFalse())
+		It("should serve files from the assets folder and keep action routes first", func() {
+			svc := assetsService(map[string]interface{}{"folder": folder, "path": "/"})
 
-			Expect(payload.Get("name").Exists()).Should(BeTrue())
-			Expect(payload.Get("name").String()).Should(Equal("John"))
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/", nil))
+			Expect(response.Code).Should(Equal(http.StatusOK))
+			Expect(response.Body.String()).Should(Equal("<h1>Hello</h1>"))
 
-			Expect(payload.Get("actions").Exists()).Should(BeTrue())
-			Expect(payload.Get("actions").StringArray()).Should(Equal([]string{"first", "second"}))
+			response = httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/user/list", nil))
+			Expect(response.Body.String()).Should(Equal("ok"))
+		})
+
+		It("should serve files on a custom path", func() {
+			svc := assetsService(map[string]interface{}{"folder": folder, "path": "/static/"})
 
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/static/", nil))
+			Expect(response.Code).Should(Equal(http.StatusOK))
+			Expect(response.Body.String()).Should(Equal("<h1>Hello</h1>"))
 		})
 
-		It("should get params from the body and URL", func() {
-			bodyIo := strings.NewReader(`name=Janet&age=47`)
-			request := httptest.NewRequest("POST", "http://local/path?forced=maybe", bodyIo)
-			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		It("should serve index.html for client routes when spaFallback is on", func() {
+			svc := assetsService(map[string]interface{}{"folder": folder, "path": "/", "spaFallback": true})
 
-			payload := paramsFromRequest(request, log.WithField("unit", "test"))
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/42/profile", nil))
+			Expect(response.Code).Should(Equal(http.StatusOK))
+			Expect(response.Body.String()).Should(Equal("<h1>Hello</h1>"))
 
-			Expect(payload.Get("forced").Exists()).Should(BeTrue())
-			Expect(payload.Get("forced").String()).Should(Equal("maybe"))
+			response = httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/missing.js", nil))
+			Expect(response.Code).Should(Equal(http.StatusNotFound))
 
-			Expect(payload.Get("age").Exists()).Should(BeTrue())
-			Expect(payload.Get("age").Int()).Should(Equal(47))
+			response = httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/user/list", nil))
+			Expect(response.Body.String()).Should(Equal("ok"))
+		})
 
-			Expect(payload.Get("name").Exists()).Should(BeTrue())
-			Expect(payload.Get("name").String()).Should(Equal("Janet"))
+		It("should respond 404 for client routes when spaFallback is off", func() {
+			svc := assetsService(map[string]interface{}{"folder": folder, "path": "/"})
+
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/42/profile", nil))
+			Expect(response.Code).Should(Equal(http.StatusNotFound))
 		})
 
+		It("should not serve anything when the folder does not exist", func() {
+			svc := assetsService(map[string]interface{}{"folder": filepath.Join(folder, "missing"), "path": "/"})
+
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/index.html", nil))
+			Expect(response.Code).Should(Equal(http.StatusNotFound))
+		})
 	})
 
-	It("acceptedMethods should return accept methodscoming from the alias", func() {
-		handler := actionHandler{alias: "GET users"}
-		Expect(handler.acceptedMethods()).Should(BeEquivalentTo(map[string]bool{
-			"GET": true,
-		}))
+	Describe("rebuildActionsRouter", func() {
+		userService := func(actions ...string) map[string]interface{} {
+			serviceActions := map[string]map[string]interface{}{}
+			for _, action := range actions {
+				serviceActions[action] = map[string]interface{}{"name": "user." + action, "rawName": action}
+			}
+			return map[string]interface{}{"name": "user", "actions": serviceActions}
+		}
 
-		handler = actionHandler{alias: "POST users"}
-		Expect(handler.acceptedMethods()).Should(BeEquivalentTo(map[string]bool{
-			"POST": true,
-		}))
+		It("should swap the action routes without dropping in-flight requests", func() {
+			release := make(chan bool)
+			services := []map[string]interface{}{userService("slow")}
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				switch ctx.ActionName() {
+				case "$node.services":
+					return services
+				case "user.slow":
+					<-release
+					return "slow done"
+				}
+				return "fast done"
+			})
+			svc := &HttpService{
+				settings: map[string]interface{}{"routes": defaultRoutes},
+				router:   mux.NewRouter(),
+			}
+			svc.reveserProxy(ctx.(moleculer.BrokerContext))
+			Expect(svc.rebuildActionsRouter(ctx)).Should(Equal([]string{"/user/slow"}))
+			server := httptest.NewServer(svc.router)
+			defer server.Close()
+
+			slowResponse := make(chan string, 1)
+			go func() {
+				response, err := http.Get(server.URL + "/user/slow")
+				if err != nil {
+					slowResponse <- err.Error()
+					return
+				}
+				body, _ := ioutil.ReadAll(response.Body)
+				slowResponse <- string(body)
+			}()
+			Consistently(slowResponse, 100*time.Millisecond).ShouldNot(Receive())
+
+			services = []map[string]interface{}{userService("fast")}
+			Expect(svc.rebuildActionsRouter(ctx)).Should(Equal([]string{"/user/fast"}))
+
+			response, err := http.Get(server.URL + "/user/fast")
+			Expect(err).Should(Succeed())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			response, err = http.Get(server.URL + "/user/slow")
+			Expect(err).Should(Succeed())
+			Expect(response.StatusCode).Should(Equal(http.StatusNotFound))
+
+			close(release)
+			Eventually(slowResponse).Should(Receive(Equal("slow done")))
+		})
 
-		handler = actionHandler{alias: "PUT some/path/big"}
-		Expect(handler.acceptedMethods()).Should(BeEquivalentTo(map[string]bool{
-			"PUT": true,
-		}))
+		It("should respond 503 with Retry-After until the first action routes are built", func() {
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				if ctx.ActionName() == "$node.services" {
+					return []map[string]interface{}{userService("list")}
+				}
+				return "listed"
+			})
+			svc := &HttpService{settings: map[string]interface{}{"routes": defaultRoutes}}
+			handler := svc.buildRouter(ctx.(moleculer.BrokerContext))
+
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/user/list", nil))
+			Expect(response.Code).Should(Equal(http.StatusServiceUnavailable))
+			Expect(response.Header().Get("Retry-After")).Should(Equal("1"))
+			Expect(response.Body.String()).Should(Equal(`{"error":"Gateway routes not ready"}`))
+
+			svc.rebuildActionsRouter(ctx)
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/user/list", nil))
+			Expect(response.Code).Should(Equal(http.StatusOK))
+			Expect(response.Body.String()).Should(Equal("listed"))
+		})
 
-		handler = actionHandler{alias: "DELETE two/paths"}
-		Expect(handler.acceptedMethods()).Should(BeEquivalentTo(map[string]bool{
-			"DELETE": true,
-		}))
+		It("should coalesce a burst of service added events into a single rebuild", func() {
+			var rebuilds int32
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				if ctx.ActionName() == "$node.services" {
+					atomic.AddInt32(&rebuilds, 1)
+					return []map[string]interface{}{userService("list")}
+				}
+				return "ok"
+			})
+			svc := &HttpService{
+				settings: map[string]interface{}{
+					"routes":          defaultRoutes,
+					"rebuildDebounce": 50 * time.Millisecond,
+				},
+			}
+			svc.handler = svc.buildRouter(ctx.(moleculer.BrokerContext))
+			for i := 0; i < 10; i++ {
+				svc.servicesChanged(ctx, payload.Empty())
+				time.Sleep(5 * time.Millisecond)
+			}
+			Eventually(func() int32 { return atomic.LoadInt32(&rebuilds) }).Should(Equal(int32(1)))
+			Consistently(func() int32 { return atomic.LoadInt32(&rebuilds) }, 150*time.Millisecond).Should(Equal(int32(1)))
+			Expect(svc.currentActionsRouter()).ShouldNot(BeNil())
+		})
 
-		handler = actionHandler{alias: "two/paths"}
-		Expect(handler.acceptedMethods()).Should(BeEquivalentTo(map[string]bool{
-			"GET":    true,
-			"POST":   true,
-			"PUT":    true,
-			"DELETE": true,
-		}))
-	})
+		It("should rebuild on every event when rebuildDebounce is zero", func() {
+			var rebuilds int32
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				atomic.AddInt32(&rebuilds, 1)
+				return []map[string]interface{}{userService("list")}
+			})
+			svc := &HttpService{
+				settings: map[string]interface{}{"routes": defaultRoutes},
+			}
+			svc.handler = svc.buildRouter(ctx.(moleculer.BrokerContext))
+			for i := 0; i < 3; i++ {
+				svc.servicesChanged(ctx, payload.Empty())
+			}
+			Eventually(func() int32 { return atomic.LoadInt32(&rebuilds) }).Should(Equal(int32(3)))
+		})
 
-	It("invertStringMap should swap map keys/values", func() {
-		aliases := map[string]string{
-			"GET users":  "users.list",
-			"POST login": "auth.login",
-		}
-		inverted := invertStringMap(aliases)
-		Expect(inverted).Should(BeEquivalentTo(map[string]string{
-			"users.list": "GET users",
-			"auth.login": "POST login",
-		}))
+		It("should drop the routes of a removed service", func() {
+			services := []map[string]interface{}{userService("list")}
+			var mutex sync.Mutex
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return services
+			})
+			svc := &HttpService{
+				settings: map[string]interface{}{"routes": defaultRoutes},
+			}
+			svc.handler = svc.buildRouter(ctx.(moleculer.BrokerContext))
+			Expect(svc.rebuildActionsRouter(ctx)).Should(Equal([]string{"/user/list"}))
+
+			mutex.Lock()
+			services = []map[string]interface{}{}
+			mutex.Unlock()
+			for _, event := range svc.Events() {
+				if event.Name == "$registry.service.removed" {
+					event.Handler(ctx, payload.Empty())
+				}
+			}
+			Eventually(svc.ActionPaths).Should(BeEmpty())
+		})
+
+		It("should serialize the rebuilds so an older snapshot never replaces a newer one", func() {
+			var fetches int32
+			fetching, release := make(chan bool), make(chan bool)
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				if atomic.AddInt32(&fetches, 1) == 1 {
+					fetching <- true
+					<-release
+					return []map[string]interface{}{userService("old")}
+				}
+				return []map[string]interface{}{userService("new")}
+			})
+			svc := &HttpService{
+				settings: map[string]interface{}{"routes": defaultRoutes},
+			}
+			svc.handler = svc.buildRouter(ctx.(moleculer.BrokerContext))
+			svc.servicesChanged(ctx, payload.Empty())
+			<-fetching
+			svc.servicesChanged(ctx, payload.Empty())
+			Consistently(func() int32 { return atomic.LoadInt32(&fetches) }, 50*time.Millisecond).Should(Equal(int32(1)))
+
+			close(release)
+			Eventually(svc.ActionPaths).Should(Equal([]string{"/user/new"}))
+			Consistently(svc.ActionPaths, 50*time.Millisecond).Should(Equal([]string{"/user/new"}))
+		})
 	})
 
-	Describe("createActionHandlers", func() {
+	Describe("optimizeOrder", func() {
+		It("should order patterns by specificity", func() {
+			Expect(moreSpecific("/users/me", "/{entity}/{id}")).Should(BeTrue())
+			Expect(moreSpecific("/users/{id}", "/{entity}/{id}")).Should(BeTrue())
+			Expect(moreSpecific("/users/me/profile", "/users/me")).Should(BeTrue())
+			Expect(moreSpecific("/users/list", "/user/list")).Should(BeTrue())
+			Expect(moreSpecific("/{entity}/{id}", "/users/me")).Should(BeFalse())
+
+			handlers := []*actionHandler{
+				{alias: "GET :entity/:id", routePath: "/", action: "generic.get"},
+				{alias: "GET users/:id", routePath: "/", action: "users.get"},
+				{alias: "GET users/me", routePath: "/", action: "users.me"},
+			}
+			sortBySpecificity(handlers)
+			Expect([]string{handlers[0].action, handlers[1].action, handlers[2].action}).Should(Equal([]string{"users.me", "users.get", "generic.get"}))
+		})
 
-		It("should only create actions with alias", func() {
-			route := map[string]interface{}{
-				"path":          "/admin",
-				"mappingPolicy": "restrict",
-				"aliases": map[string]string{
-					"GET users": "user.list",
-					"login":     "auth.login",
+		routerFor := func(optimizeOrder bool) *mux.Router {
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				if ctx.ActionName() == "$node.services" {
+					return []map[string]interface{}{
+						{"name": "generic", "actions": map[string]map[string]interface{}{
+							"get": {"name": "generic.get", "rawName": "get"},
+						}},
+						{"name": "users", "actions": map[string]map[string]interface{}{
+							"me": {"name": "users.me", "rawName": "me"},
+						}},
+					}
+				}
+				return ctx.ActionName()
+			})
+			settings := map[string]interface{}{
+				"optimizeOrder": optimizeOrder,
+				"routes": []map[string]interface{}{
+					{
+						"path": "/",
+						"aliases": map[string]string{
+							"GET :entity/:id": "generic.get",
+							"GET users/me":    "users.me",
+						},
+					},
 				},
 			}
+			router := mux.NewRouter()
+			populateActionsRouter(ctx, settings, router)
+			return router
+		}
 
-			actionHandlers := createActionHandlers(
-				route,
-				[]string{"user.list", "user.remove", "auth.login"},
-			)
-			Expect(len(actionHandlers)).Should(Equal(2))
+		It("should let a specific route win over a catch-all registered before it", func() {
+			response := httptest.NewRecorder()
+			routerFor(true).ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/me", nil))
+			Expect(response.Body.String()).Should(Equal("users.me"))
 
-			Expect(actionHandlers[0].action).Should(Equal("user.list"))
-			Expect(actionHandlers[0].pattern()).Should(Equal("/admin/users"))
-			Expect(actionHandlers[0].alias).Should(Equal("GET users"))
+			response = httptest.NewRecorder()
+			routerFor(true).ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/orders/10", nil))
+			Expect(response.Body.String()).Should(Equal("generic.get"))
+		})
 
-			Expect(actionHandlers[1].action).Should(Equal("auth.login"))
-			Expect(actionHandlers[1].pattern()).Should(Equal("/admin/login"))
-			Expect(actionHandlers[1].alias).Should(Equal("login"))
+		It("should keep the registration order when optimizeOrder is off", func() {
+			response := httptest.NewRecorder()
+			routerFor(false).ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/me", nil))
+			Expect(response.Body.String()).Should(Equal("generic.get"))
 		})
+	})
 
-		It("should create action handler with route path and action name", func() {
-			route := map[string]interface{}{
-				"path": "/api",
+	Describe("concurrent reload and stop", func() {
+		It("should guard the server and action paths when reloads and stop run concurrently", func() {
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				return []map[string]interface{}{}
+			})
+			svc := &HttpService{Settings: map[string]interface{}{
+				"ip":   "127.0.0.1",
+				"port": "3568",
+			}}
+			svc.Started(ctx.(moleculer.BrokerContext), moleculer.ServiceSchema{})
+			var group sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				group.Add(2)
+				go func() {
+					defer group.Done()
+					svc.servicesChanged(ctx, payload.Empty())
+				}()
+				go func() {
+					defer group.Done()
+					svc.ActionPaths()
+				}()
 			}
+			group.Add(1)
+			go func() {
+				defer group.Done()
+				svc.Stopped(ctx.(moleculer.BrokerContext), moleculer.ServiceSchema{})
+			}()
+			group.Wait()
+			Eventually(func() error {
+				_, err := http.Get("http://127.0.0.1:3568/")
+				return err
+			}).ShouldNot(Succeed())
+		})
+	})
 
-			actionHandlers := createActionHandlers(route, []string{"user.list", "auth.login"})
-			Expect(len(actionHandlers)).Should(Equal(2))
+	Describe("serveHealth", func() {
+		It("should respond 200 with the gateway status on the healthPath", func() {
+			svc := &HttpService{settings: map[string]interface{}{"healthPath": "/~health"}, router: mux.NewRouter()}
+			svc.serveHealth(echoActionContext().(moleculer.BrokerContext))
+			svc.setActionPaths([]string{"/user/list", "/user/get"})
 
-			Expect(actionHandlers[0].action).Should(Equal("user.list"))
-			Expect(actionHandlers[0].pattern()).Should(Equal("/api/user/list"))
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/~health", nil))
+			Expect(response.Code).Should(Equal(http.StatusOK))
+			Expect(response.Header().Get("Content-Type")).Should(Equal("application/json"))
+			body := response.Body.String()
+			Expect(gjson.Get(body, "status").String()).Should(Equal("ok"))
+			Expect(gjson.Get(body, "uptime").Exists()).Should(BeTrue())
+			Expect(gjson.Get(body, "actions").Int()).Should(Equal(int64(2)))
+		})
 
-			Expect(actionHandlers[1].action).Should(Equal("auth.login"))
-			Expect(actionHandlers[1].pattern()).Should(Equal("/api/auth/login"))
+		It("should respond 503 until the requiredServices are available", func() {
+			var available int32
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				services := []map[string]interface{}{{"name": "users"}}
+				if atomic.LoadInt32(&available) == 1 {
+					services = append(services, map[string]interface{}{"name": "orders"})
+				}
+				return services
+			})
+			settings := map[string]interface{}{"healthPath": "/~health", "requiredServices": []string{"users", "orders"}}
+			svc := &HttpService{settings: settings, router: mux.NewRouter()}
+			svc.serveHealth(ctx.(moleculer.BrokerContext))
+
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/~health", nil))
+			Expect(response.Code).Should(Equal(http.StatusServiceUnavailable))
+			Expect(response.Body.String()).Should(Equal(`{"missing":["orders"],"status":"not ready"}`))
+
+			atomic.StoreInt32(&available, 1)
+			response = httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/~health", nil))
+			Expect(response.Code).Should(Equal(http.StatusOK))
+			Expect(gjson.Get(response.Body.String(), "status").String()).Should(Equal("ok"))
+
+			atomic.StoreInt32(&available, 0)
+			response = httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/~health", nil))
+			Expect(response.Code).Should(Equal(http.StatusServiceUnavailable))
+		})
 
-			route = map[string]interface{}{
-				"path": "/somePrefix/",
-			}
-			actionHandlers = createActionHandlers(route, []string{"profile.create", "image.upload", "msg.send"})
-			Expect(len(actionHandlers)).Should(Equal(3))
+		It("should not register the endpoint when healthPath is empty", func() {
+			svc := &HttpService{settings: map[string]interface{}{"healthPath": ""}, router: mux.NewRouter()}
+			svc.serveHealth(echoActionContext().(moleculer.BrokerContext))
 
-			Expect(actionHandlers[0].action).Should(Equal("profile.create"))
-			Expect(actionHandlers[0].pattern()).Should(Equal("/somePrefix/profile/create"))
-			Expect(actionHandlers[0].action).Should(Equal("profile.create"))
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/~health", nil))
+			Expect(response.Code).Should(Equal(http.StatusNotFound))
 		})
 	})
 
-	Describe("shouldInclude", func() {
-		var actions = []string{
-			"user.list",
-			"user.get",
-			"user.create",
-			"user.remove",
-			"user.update",
+	Describe("serveRoutes", func() {
+		It("should list the path, methods and action of the action routes", func() {
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				return []map[string]interface{}{{"name": "user", "actions": map[string]map[string]interface{}{
+					"list":   {"name": "user.list"},
+					"create": {"name": "user.create"},
+				}}}
+			})
+			routes := []map[string]interface{}{{
+				"name":          "api",
+				"path":          "/",
+				"mappingPolicy": "restrict",
+				"aliases":       map[string]string{"GET users": "user.list", "POST users": "user.create"},
+			}}
+			svc := &HttpService{settings: map[string]interface{}{"routes": routes, "routesPath": "/~routes"}, router: mux.NewRouter()}
+			svc.serveRoutes(ctx.(moleculer.BrokerContext))
+			svc.reveserProxy(ctx.(moleculer.BrokerContext))
+			svc.rebuildActionsRouter(ctx)
+
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/~routes", nil))
+			Expect(response.Code).Should(Equal(http.StatusOK))
+			listing := gjson.Parse(response.Body.String())
+			Expect(listing.Array()).Should(HaveLen(2))
+			list := listing.Get(`#[action=="user.list"]`)
+			Expect(list.Get("path").String()).Should(Equal("/users"))
+			Expect(list.Get("methods").String()).Should(Equal(`["GET","HEAD"]`))
+			Expect(list.Get("route").String()).Should(Equal("api"))
+			create := listing.Get(`#[action=="user.create"]`)
+			Expect(create.Get("path").String()).Should(Equal("/users"))
+			Expect(create.Get("methods").String()).Should(Equal(`["POST"]`))
+		})
+	})
 
-			"profile.list",
-			"profile.get",
-			"profile.create",
-			"profile.remove",
-			"profile.update",
+	Describe("caseInsensitiveRoutes", func() {
+		ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+			if ctx.ActionName() == "$node.services" {
+				return []map[string]interface{}{{"name": "users", "actions": map[string]map[string]interface{}{
+					"list": {"name": "users.list"},
+					"get":  {"name": "users.get"},
+				}}}
+			}
+			return payload.Empty().Add("action", ctx.ActionName()).Add("params", ctx.Payload())
+		})
+		routes := []map[string]interface{}{{
+			"path":    "/api",
+			"aliases": map[string]string{"GET users/:id": "users.get"},
+		}}
+		serve := func(caseInsensitive bool, path string) *httptest.ResponseRecorder {
+			settings := map[string]interface{}{"routes": routes, "optimizeOrder": true, "caseInsensitiveRoutes": caseInsensitive}
+			svc := &HttpService{settings: settings, router: mux.NewRouter()}
+			svc.reveserProxy(ctx.(moleculer.BrokerContext))
+			svc.rebuildActionsRouter(ctx)
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local"+path, nil))
+			return response
+		}
 
-			"auth.login",
-			"auth.logout",
+		It("should route /API/USERS/list to the users.list action", func() {
+			response := serve(true, "/API/USERS/list")
+			Expect(response.Code).Should(Equal(http.StatusOK))
+			Expect(gjson.Get(response.Body.String(), "action").String()).Should(Equal("users.list"))
+		})
 
-			"math.add",
-			"math.subtract",
-		}
-		It("must return true for **", func() {
-			for _, action := range actions {
-				Expect(shouldInclude([]string{"**"}, action)).Should(BeTrue())
-				Expect(shouldInclude([]string{"*.*"}, action)).Should(BeTrue())
-			}
+		It("should keep the case of the path params", func() {
+			response := serve(true, "/api/Users/AbC")
+			Expect(gjson.Get(response.Body.String(), "action").String()).Should(Equal("users.get"))
+			Expect(gjson.Get(response.Body.String(), "params.id").String()).Should(Equal("AbC"))
 		})
 
-		It("must handle action wildcards service.*", func() {
-			Expect(shouldInclude([]string{"user.*"}, "user.list")).Should(BeTrue())
-			Expect(shouldInclude([]string{"profile.*"}, "user.list")).Should(BeFalse())
+		It("should not match other cases when caseInsensitiveRoutes is off", func() {
+			Expect(serve(false, "/api/USERS/list").Code).Should(Equal(http.StatusNotFound))
+			Expect(serve(false, "/api/users/list").Code).Should(Equal(http.StatusOK))
+		})
+	})
 
-			Expect(shouldInclude([]string{"user.*"}, "profile.list")).Should(BeFalse())
-			Expect(shouldInclude([]string{"profile.*"}, "profile.list")).Should(BeTrue())
+	Describe("route cors", func() {
+		ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+			if ctx.ActionName() == "$node.services" {
+				return []map[string]interface{}{{"name": "users", "actions": map[string]map[string]interface{}{
+					"list": {"name": "users.list"},
+				}}, {"name": "widget", "actions": map[string]map[string]interface{}{
+					"show": {"name": "widget.show"},
+				}}}
+			}
+			return ctx.ActionName()
 		})
+		settings := map[string]interface{}{
+			"cors": map[string]interface{}{"allowedOrigins": []string{"https://app.example.com"}},
+			"routes": []map[string]interface{}{{
+				"path":      "/public",
+				"whitelist": []string{"widget.*"},
+				"cors":      map[string]interface{}{"allowedOrigins": []string{"*"}},
+			}, {
+				"path":      "/api",
+				"whitelist": []string{"users.*"},
+			}},
+		}
+		svc := &HttpService{settings: settings, router: mux.NewRouter()}
+		svc.reveserProxy(ctx.(moleculer.BrokerContext))
+		svc.rebuildActionsRouter(ctx)
+		handler := svc.wrapHandler(ctx.(moleculer.BrokerContext), svc.router)
+		serve := func(method, path, origin string) *httptest.ResponseRecorder {
+			request := httptest.NewRequest(method, "http://local"+path, nil)
+			request.Header.Set("Origin", origin)
+			if method == http.MethodOptions {
+				request.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			return response
+		}
 
-		It("must handle action wildcards *.list", func() {
-			Expect(shouldInclude([]string{"*.list"}, "user.list")).Should(BeTrue())
-			Expect(shouldInclude([]string{"*.list"}, "profile.list")).Should(BeTrue())
-			Expect(shouldInclude([]string{"*.create"}, "user.list")).Should(BeFalse())
+		It("should use the route cors settings instead of the global ones", func() {
+			response := serve(http.MethodGet, "/public/widget/show", "https://blog.example.org")
+			Expect(response.Body.String()).Should(Equal("widget.show"))
+			Expect(response.Header().Get("Access-Control-Allow-Origin")).Should(Equal("*"))
 
-			Expect(shouldInclude([]string{"*.create"}, "user.create")).Should(BeTrue())
-			Expect(shouldInclude([]string{"*.create"}, "profile.create")).Should(BeTrue())
-			Expect(shouldInclude([]string{"*.create"}, "auth.login")).Should(BeFalse())
+			response = serve(http.MethodGet, "/api/users/list", "https://blog.example.org")
+			Expect(response.Body.String()).Should(Equal("users.list"))
+			Expect(response.Header().Get("Access-Control-Allow-Origin")).Should(Equal(""))
+
+			response = serve(http.MethodGet, "/api/users/list", "https://app.example.com")
+			Expect(response.Header().Get("Access-Control-Allow-Origin")).Should(Equal("https://app.example.com"))
 		})
 
-		It("must handle regular expressions", func() {
-			Expect(shouldInclude([]string{".*\\.list"}, "user.list")).Should(BeTrue())
-			Expect(shouldInclude([]string{".*\\.list"}, "profile.list")).Should(BeTrue())
-			Expect(shouldInclude([]string{".*\\.list"}, "v1.auth.list")).Should(BeTrue())
+		It("should answer the preflight requests with the route cors settings", func() {
+			response := serve(http.MethodOptions, "/public/widget/show", "https://blog.example.org")
+			Expect(response.Header().Get("Access-Control-Allow-Origin")).Should(Equal("*"))
+
+			response = serve(http.MethodOptions, "/api/users/list", "https://blog.example.org")
+			Expect(response.Header().Get("Access-Control-Allow-Origin")).Should(Equal(""))
 		})
 	})
 
-})
+	Describe("basePath", func() {
+		ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+			if ctx.ActionName() == "$node.services" {
+				return []map[string]interface{}{{"name": "users", "actions": map[string]map[string]interface{}{
+					"list": {"name": "users.list"},
+				}}}
+			}
+			return ctx.ActionName()
+		})
 
-type handlerSorter struct {
-	actionHandlers []*actionHandler
-}
+		It("should mount the action routes under the basePath", func() {
+			svc := &HttpService{settings: map[string]interface{}{"routes": defaultRoutes, "basePath": "/api/v1"}, router: mux.NewRouter()}
+			svc.reveserProxy(ctx.(moleculer.BrokerContext))
+			Expect(svc.rebuildActionsRouter(ctx)).Should(Equal([]string{"/users/list"}))
 
-func (h handlerSorter) Len() int {
-	return len(h.actionHandlers)
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/api/v1/users/list", nil))
+			Expect(response.Code).Should(Equal(http.StatusOK))
+			Expect(response.Body.String()).Should(Equal("users.list"))
+
+			response = httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			Expect(response.Code).Should(Equal(http.StatusNotFound))
+		})
+
+		It("should join the basePath with the reverse proxy gatewayPath", func() {
+			settings := map[string]interface{}{
+				"routes":       defaultRoutes,
+				"basePath":     "api/v1/",
+				"reverseProxy": map[string]interface{}{"gatewayPath": "/gw", "target": "http://localhost:3573", "targetPath": "/app"},
+			}
+			svc := &HttpService{settings: settings, router: mux.NewRouter()}
+			svc.reveserProxy(ctx.(moleculer.BrokerContext))
+			svc.rebuildActionsRouter(ctx)
+			Expect(svc.actionsPrefix).Should(Equal("/api/v1/gw"))
+
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/api/v1/gw/users/list", nil))
+			Expect(response.Body.String()).Should(Equal("users.list"))
+		})
+	})
+
+	Describe("reverseProxy", func() {
+		ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+			if ctx.ActionName() == "$node.services" {
+				return []map[string]interface{}{{"name": "users", "actions": map[string]map[string]interface{}{
+					"list": {"name": "users.list"},
+				}}}
+			}
+			return ctx.ActionName()
+		})
+		newUpstream := func(name string) *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				response.Write([]byte(name + " " + request.URL.Path))
+			}))
+		}
+		serve := func(reverseProxy map[string]interface{}, path string) *httptest.ResponseRecorder {
+			svc := &HttpService{settings: map[string]interface{}{"routes": defaultRoutes, "reverseProxy": reverseProxy}, router: mux.NewRouter()}
+			svc.router.NotFoundHandler = notFoundHandler(svc.settings, log.WithField("unit", "test"))
+			svc.reveserProxy(ctx.(moleculer.BrokerContext))
+			svc.rebuildActionsRouter(ctx)
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local"+path, nil))
+			return response
+		}
+
+		It("should serve the routes and whitelist from settings under the gatewayPath", func() {
+			upstream := newUpstream("upstream")
+			defer upstream.Close()
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				if ctx.ActionName() == "$node.services" {
+					return []map[string]interface{}{{"name": "users", "actions": map[string]map[string]interface{}{
+						"list":   {"name": "users.list"},
+						"remove": {"name": "users.remove"},
+					}}}
+				}
+				return ctx.ActionName()
+			})
+			settings := map[string]interface{}{
+				"routes":       []map[string]interface{}{{"path": "/admin", "whitelist": []string{"users.list"}}},
+				"reverseProxy": map[string]interface{}{"gatewayPath": "/api", "target": upstream.URL},
+			}
+			svc := &HttpService{settings: settings, router: mux.NewRouter()}
+			svc.reveserProxy(ctx.(moleculer.BrokerContext))
+			Expect(svc.rebuildActionsRouter(ctx)).Should(Equal([]string{"/admin/users/list"}))
+
+			serve := func(path string) *httptest.ResponseRecorder {
+				response := httptest.NewRecorder()
+				svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local"+path, nil))
+				return response
+			}
+			Expect(serve("/api/admin/users/list").Body.String()).Should(Equal("users.list"))
+			Expect(serve("/api/admin/users/remove").Body.String()).Should(Equal("upstream /api/admin/users/remove"))
+			Expect(serve("/app").Body.String()).Should(Equal("upstream /app"))
+		})
+
+		It("should proxy each targetPath to its target", func() {
+			app := newUpstream("app")
+			defer app.Close()
+			admin := newUpstream("admin")
+			defer admin.Close()
+			settings := map[string]interface{}{
+				"routes": defaultRoutes,
+				"reverseProxy": []map[string]interface{}{
+					{"gatewayPath": "/gw", "targetPath": "/", "target": app.URL},
+					{"targetPath": "/admin", "target": admin.URL},
+				},
+			}
+			svc := &HttpService{settings: settings, router: mux.NewRouter()}
+			svc.reveserProxy(ctx.(moleculer.BrokerContext))
+			svc.rebuildActionsRouter(ctx)
+			Expect(svc.actionsPrefix).Should(Equal("/gw"))
+
+			serve := func(path string) string {
+				response := httptest.NewRecorder()
+				svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local"+path, nil))
+				return response.Body.String()
+			}
+			Expect(serve("/admin/users")).Should(Equal("admin /admin/users"))
+			Expect(serve("/app/home")).Should(Equal("app /app/home"))
+			Expect(serve("/")).Should(Equal("app /"))
+			Expect(serve("/gw/users/list")).Should(Equal("users.list"))
+		})
+
+		It("should rewrite the path before forwarding it to the target", func() {
+			upstream := newUpstream("upstream")
+			defer upstream.Close()
+			stripped := map[string]interface{}{"target": upstream.URL, "targetPath": "/app", "rewrite": map[string]interface{}{"stripPrefix": "/app"}}
+			Expect(serve(stripped, "/app/users/1").Body.String()).Should(Equal("upstream /users/1"))
+			Expect(serve(stripped, "/app").Body.String()).Should(Equal("upstream /"))
+
+			replaced := map[string]interface{}{"target": upstream.URL, "rewrite": map[string]interface{}{"pattern": "^/v1/(.*)$", "replacement": "/api/v1/$1"}}
+			Expect(serve(replaced, "/v1/users").Body.String()).Should(Equal("upstream /api/v1/users"))
+			Expect(serve(replaced, "/v2/users").Body.String()).Should(Equal("upstream /v2/users"))
+		})
+
+		It("should respond a JSON 502 when the target is unreachable", func() {
+			upstream := newUpstream("upstream")
+			upstream.Close()
+			response := serve(map[string]interface{}{"target": upstream.URL, "dialTimeout": time.Second}, "/app")
+			Expect(response.Code).Should(Equal(http.StatusBadGateway))
+			Expect(response.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Expect(response.Body.String()).Should(Equal(`{"error":"Bad Gateway - target: ` + upstream.URL + ` is unreachable"}`))
+		})
+
+		It("should respond a JSON 504 when the target does not respond in time", func() {
+			release := make(chan bool)
+			upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				<-release
+			}))
+			defer upstream.Close()
+			defer close(release)
+			response := serve(map[string]interface{}{"target": upstream.URL, "responseTimeout": 50 * time.Millisecond}, "/app")
+			Expect(response.Code).Should(Equal(http.StatusGatewayTimeout))
+			Expect(gjson.Get(response.Body.String(), "error").String()).Should(ContainSubstring("Gateway Timeout"))
+		})
+
+		It("should not proxy the paths under proxyExclude", func() {
+			upstream := newUpstream("upstream")
+			defer upstream.Close()
+			reverseProxy := map[string]interface{}{"gatewayPath": "/api", "target": upstream.URL, "targetPath": "/", "proxyExclude": []string{"/internal"}}
+			Expect(serve(reverseProxy, "/app/page").Body.String()).Should(Equal("upstream /app/page"))
+			Expect(serve(reverseProxy, "/internals").Body.String()).Should(Equal("upstream /internals"))
+			Expect(serve(reverseProxy, "/api/users/list").Body.String()).Should(Equal("users.list"))
+
+			for _, path := range []string{"/internal", "/internal/secret"} {
+				response := serve(reverseProxy, path)
+				Expect(response.Code).Should(Equal(http.StatusNotFound))
+				Expect(gjson.Get(response.Body.String(), "error").String()).Should(Equal("Not Found - path: " + path))
+			}
+		})
+	})
+
+	Describe("strictSlash", func() {
+		ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+			if ctx.ActionName() == "$node.services" {
+				return []map[string]interface{}{{"name": "users", "actions": map[string]map[string]interface{}{
+					"list": {"name": "users.list"},
+				}}}
+			}
+			return ctx.ActionName()
+		})
+		routes := []map[string]interface{}{{"path": "/", "aliases": map[string]string{"GET users": "users.list"}}}
+		server := func(strictSlash bool) *httptest.Server {
+			svc := &HttpService{settings: map[string]interface{}{"routes": routes, "strictSlash": strictSlash}, router: mux.NewRouter()}
+			svc.reveserProxy(ctx.(moleculer.BrokerContext))
+			svc.rebuildActionsRouter(ctx)
+			return httptest.NewServer(svc.router)
+		}
+
+		It("should reach the action with and without the trailing slash", func() {
+			srv := server(true)
+			defer srv.Close()
+			for _, path := range []string{"/users", "/users/"} {
+				response, err := http.Get(srv.URL + path)
+				Expect(err).Should(Succeed())
+				body, _ := ioutil.ReadAll(response.Body)
+				response.Body.Close()
+				Expect(response.StatusCode).Should(Equal(http.StatusOK))
+				Expect(string(body)).Should(Equal("users.list"))
+			}
+		})
+
+		It("should make the trailing slash optional for the caseInsensitiveRoutes", func() {
+			svc := &HttpService{settings: map[string]interface{}{"routes": routes, "strictSlash": true, "caseInsensitiveRoutes": true}, router: mux.NewRouter()}
+			svc.reveserProxy(ctx.(moleculer.BrokerContext))
+			svc.rebuildActionsRouter(ctx)
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/Users/", nil))
+			Expect(response.Body.String()).Should(Equal("users.list"))
+		})
+
+		It("should not match the trailing slash when strictSlash is off", func() {
+			srv := server(false)
+			defer srv.Close()
+			response, err := http.Get(srv.URL + "/users/")
+			Expect(err).Should(Succeed())
+			response.Body.Close()
+			Expect(response.StatusCode).Should(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("serveOpenAPI", func() {
+		It("should generate the OpenAPI paths of the action routes with their methods and params", func() {
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				return []map[string]interface{}{{"name": "user", "actions": map[string]map[string]interface{}{
+					"get":    {"name": "user.get"},
+					"create": {"name": "user.create", "params": map[string]interface{}{"name": "string", "age": map[string]interface{}{"type": "number"}}},
+				}}}
+			})
+			routes := []map[string]interface{}{{
+				"path":          "/api",
+				"mappingPolicy": "restrict",
+				"aliases":       map[string]string{"GET users/{id:[0-9]+}": "user.get", "POST users": "user.create"},
+			}}
+			svc := &HttpService{settings: map[string]interface{}{"routes": routes, "openapiPath": "/~openapi"}, router: mux.NewRouter()}
+			svc.serveOpenAPI(ctx.(moleculer.BrokerContext))
+			svc.reveserProxy(ctx.(moleculer.BrokerContext))
+			svc.rebuildActionsRouter(ctx)
+
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/~openapi", nil))
+			Expect(response.Code).Should(Equal(http.StatusOK))
+			spec := gjson.Parse(response.Body.String())
+			Expect(spec.Get("openapi").String()).Should(Equal("3.0.0"))
+			get := spec.Get(`paths./api/users/{id}.get`)
+			Expect(get.Get("operationId").String()).Should(Equal("user.get"))
+			Expect(get.Get("tags").String()).Should(Equal(`["user"]`))
+			Expect(get.Get("parameters.0.name").String()).Should(Equal("id"))
+			Expect(get.Get("parameters.0.in").String()).Should(Equal("path"))
+			Expect(spec.Get(`paths./api/users/{id}.head`).Exists()).Should(BeFalse())
+			create := spec.Get(`paths./api/users.post`)
+			Expect(create.Get("operationId").String()).Should(Equal("user.create"))
+			schema := create.Get("requestBody.content.application/json.schema.properties")
+			Expect(schema.Get("name.type").String()).Should(Equal("string"))
+			Expect(schema.Get("age.type").String()).Should(Equal("number"))
+		})
+
+		It("should not register the endpoint when openapiPath is empty", func() {
+			svc := &HttpService{settings: map[string]interface{}{}, router: mux.NewRouter()}
+			svc.serveOpenAPI(echoActionContext().(moleculer.BrokerContext))
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/~openapi", nil))
+			Expect(response.Code).Should(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("notFoundHandler", func() {
+		It("should respond 404 with a JSON error for unmapped paths", func() {
+			svc := &HttpService{settings: map[string]interface{}{}, router: mux.NewRouter()}
+			svc.router.NotFoundHandler = notFoundHandler(svc.settings, log.WithField("unit", "test"))
+			svc.reveserProxy(echoActionContext().(moleculer.BrokerContext))
+			actions := mux.NewRouter()
+			actions.Handle("/user/list", okHandler)
+			svc.actionsRouter.Store(actions)
+
+			response := httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/user/unknown", nil))
+			Expect(response.Code).Should(Equal(http.StatusNotFound))
+			Expect(response.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Expect(gjson.Get(response.Body.String(), "error").String()).Should(Equal("Not Found - path: /user/unknown"))
+
+			response = httptest.NewRecorder()
+			svc.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/user/list", nil))
+			Expect(response.Body.String()).Should(Equal("ok"))
+		})
+
+		It("should use the notFoundHandler from settings", func() {
+			custom := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				response.WriteHeader(http.StatusTeapot)
+			})
+			router := mux.NewRouter()
+			router.NotFoundHandler = notFoundHandler(map[string]interface{}{"notFoundHandler": custom}, log.WithField("unit", "test"))
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/missing", nil))
+			Expect(response.Code).Should(Equal(http.StatusTeapot))
+		})
+	})
+
+	Describe("errorTemplates", func() {
+		settings := map[string]interface{}{"errorTemplates": map[int]interface{}{
+			404: `{"status":"missing","detail":{{json .Message}},"type":"{{.Name}}"}`,
+			500: func(err error, code int) interface{} {
+				return map[string]interface{}{"status": "failed", "detail": err.Error(), "code": code}
+			},
+		}}
+
+		It("should render the 404 responses with the template", func() {
+			router := mux.NewRouter()
+			router.NotFoundHandler = notFoundHandler(settings, log.WithField("unit", "test"))
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/user/\"unknown\"", nil))
+			Expect(response.Code).Should(Equal(http.StatusNotFound))
+			Expect(response.Body.String()).Should(Equal(`{"status":"missing","detail":"Not Found - path: /user/\"unknown\"","type":"NotFoundError"}`))
+		})
+
+		It("should render the 500 responses with the template function", func() {
+			ctx, _ := mockActionContext(errors.New("database down"))
+			handler := actionHandler{action: "users.list", settings: settings, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			Expect(response.Code).Should(Equal(http.StatusInternalServerError))
+			Expect(response.Body.String()).Should(Equal(`{"code":500,"detail":"database down","status":"failed"}`))
+		})
+
+		It("should render the errors of the middlewares with the templates", func() {
+			middlewareSettings := map[string]interface{}{
+				"errorTemplates": map[int]interface{}{
+					401: `{"status":"denied","detail":{{json .Message}}}`,
+					429: `{"status":"slow down","code":{{.Code}}}`,
+				},
+				"auth": map[string]interface{}{
+					"bearer": func(token string) (moleculer.Payload, error) {
+						return payload.Empty(), nil
+					},
+				},
+				"rateLimit": map[string]interface{}{"requestsPerSecond": 1, "burst": 1},
+			}
+			handler := bearerMiddleware(middlewareSettings, okHandler)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			Expect(response.Code).Should(Equal(http.StatusUnauthorized))
+			Expect(response.Body.String()).Should(Equal(`{"status":"denied","detail":"Missing Bearer token"}`))
+
+			handler = rateLimitMiddleware(middlewareSettings, okHandler)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			Expect(response.Code).Should(Equal(http.StatusTooManyRequests))
+			Expect(response.Body.String()).Should(Equal(`{"status":"slow down","code":429}`))
+
+			handler = recoveryMiddleware(settings, log.WithField("unit", "test"), http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				panic("boom")
+			}))
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			Expect(response.Code).Should(Equal(http.StatusInternalServerError))
+			Expect(response.Body.String()).Should(Equal(`{"code":500,"detail":"Internal Server Error","status":"failed"}`))
+		})
+
+		It("should use the default body for the other status codes", func() {
+			handler := actionHandler{alias: "GET users/list", action: "users.list", settings: settings, context: echoActionContext()}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodDelete, "http://local/users/list", nil))
+			Expect(response.Code).Should(Equal(http.StatusMethodNotAllowed))
+			Expect(gjson.Get(response.Body.String(), "error").String()).Should(ContainSubstring("Invalid HTTP Method"))
+		})
+	})
+
+	Describe("methodNotAllowedHandler", func() {
+		It("should respond 405 with the Allow header and a JSON error for a method the route doesn't accept", func() {
+			router := mux.NewRouter()
+			router.MethodNotAllowedHandler = methodNotAllowedHandler(router, map[string]interface{}{}, log.WithField("unit", "test"))
+			router.Handle("/status", okHandler).Methods("GET")
+			router.Handle("/status", okHandler).Methods("POST")
+
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, httptest.NewRequest(http.MethodDelete, "http://local/status", nil))
+			Expect(response.Code).Should(Equal(http.StatusMethodNotAllowed))
+			Expect(response.Header().Get("Allow")).Should(Equal("GET, POST"))
+			Expect(response.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Expect(gjson.Get(response.Body.String(), "error").String()).Should(Equal("Invalid HTTP Method - accepted methods: GET, POST"))
+
+			response = httptest.NewRecorder()
+			router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/status", nil))
+			Expect(response.Code).Should(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("newServer", func() {
+		It("should apply the timeouts and maxHeaderBytes from settings", func() {
+			settings := map[string]interface{}{
+				"readTimeout":    5 * time.Second,
+				"writeTimeout":   "10s",
+				"idleTimeout":    time.Minute,
+				"maxHeaderBytes": 4096,
+			}
+			server := newServer(settings, "127.0.0.1:3100", okHandler)
+			Expect(server.Addr).Should(Equal("127.0.0.1:3100"))
+			Expect(server.ReadTimeout).Should(Equal(5 * time.Second))
+			Expect(server.WriteTimeout).Should(Equal(10 * time.Second))
+			Expect(server.IdleTimeout).Should(Equal(time.Minute))
+			Expect(server.MaxHeaderBytes).Should(Equal(4096))
+		})
+
+		It("should keep the http defaults when the settings are absent", func() {
+			server := newServer(map[string]interface{}{}, ":3100", okHandler)
+			Expect(server.ReadTimeout).Should(Equal(time.Duration(0)))
+			Expect(server.WriteTimeout).Should(Equal(time.Duration(0)))
+			Expect(server.IdleTimeout).Should(Equal(time.Duration(0)))
+			Expect(server.MaxHeaderBytes).Should(Equal(0))
+		})
+	})
+
+	Describe("custom server and listener", func() {
+		It("should attach the handler to the server from settings without starting or stopping it", func() {
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				return []map[string]interface{}{}
+			})
+			custom := &http.Server{Addr: "127.0.0.1:3569"}
+			svc := &HttpService{Settings: map[string]interface{}{"server": custom}}
+			svc.Started(ctx.(moleculer.BrokerContext), moleculer.ServiceSchema{})
+			Expect(svc.getServer()).Should(BeIdenticalTo(custom))
+			Expect(custom.Handler).ShouldNot(BeNil())
+
+			var response *httptest.ResponseRecorder
+			Eventually(func() int {
+				response = httptest.NewRecorder()
+				custom.Handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/missing", nil))
+				return response.Code
+			}).Should(Equal(http.StatusNotFound))
+			Expect(gjson.Get(response.Body.String(), "error").String()).Should(Equal("Not Found - path: /missing"))
+
+			go custom.ListenAndServe()
+			Eventually(func() error {
+				_, err := http.Get("http://127.0.0.1:3569/missing")
+				return err
+			}).Should(Succeed())
+			svc.Stopped(ctx.(moleculer.BrokerContext), moleculer.ServiceSchema{})
+			_, err := http.Get("http://127.0.0.1:3569/missing")
+			Expect(err).Should(Succeed())
+			custom.Close()
+		})
+
+		It("should serve on every address of the listen setting and stop them all", func() {
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				return []map[string]interface{}{}
+			})
+			addresses := []string{"127.0.0.1:3571", "127.0.0.1:3572"}
+			svc := &HttpService{Settings: map[string]interface{}{"listen": addresses}}
+			svc.Started(ctx.(moleculer.BrokerContext), moleculer.ServiceSchema{})
+			Expect(svc.getServers()).Should(HaveLen(2))
+
+			for _, address := range addresses {
+				var response *http.Response
+				Eventually(func() error {
+					var err error
+					response, err = http.Get("http://" + address + "/~health")
+					return err
+				}).Should(Succeed())
+				response.Body.Close()
+				Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			}
+
+			svc.Stopped(ctx.(moleculer.BrokerContext), moleculer.ServiceSchema{})
+			for _, address := range addresses {
+				_, err := http.Get("http://" + address + "/~health")
+				Expect(err).Should(HaveOccurred())
+			}
+		})
+
+		It("should serve the listen addresses on the network setting", func() {
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				return []map[string]interface{}{}
+			})
+			folder, err := ioutil.TempDir("", "gateway-listen")
+			Expect(err).Should(Succeed())
+			defer os.RemoveAll(folder)
+			sockets := []string{filepath.Join(folder, "first.sock"), filepath.Join(folder, "second.sock")}
+			svc := &HttpService{Settings: map[string]interface{}{"listen": sockets, "network": "unix"}}
+			svc.Started(ctx.(moleculer.BrokerContext), moleculer.ServiceSchema{})
+			defer svc.Stopped(ctx.(moleculer.BrokerContext), moleculer.ServiceSchema{})
+
+			for _, socket := range sockets {
+				client := &http.Client{Transport: &http.Transport{
+					Dial: func(network, address string) (net.Conn, error) {
+						return net.Dial("unix", socket)
+					},
+				}}
+				var response *http.Response
+				Eventually(func() error {
+					response, err = client.Get("http://unix/~health")
+					return err
+				}).Should(Succeed())
+				response.Body.Close()
+				Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			}
+		})
+
+		It("should serve on the listener from settings", func() {
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				return []map[string]interface{}{}
+			})
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).Should(Succeed())
+			svc := &HttpService{Settings: map[string]interface{}{"listener": listener}}
+			svc.Started(ctx.(moleculer.BrokerContext), moleculer.ServiceSchema{})
+			defer svc.Stopped(ctx.(moleculer.BrokerContext), moleculer.ServiceSchema{})
+
+			var response *http.Response
+			Eventually(func() error {
+				response, err = http.Get("http://" + listener.Addr().String() + "/missing")
+				return err
+			}).Should(Succeed())
+			Expect(response.StatusCode).Should(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("startServer", func() {
+		delegates := test.DelegatesWithIdAndConfig(
+			"nodeID",
+			moleculer.Config{},
+		)
+		emitted := make(chan moleculer.BrokerContext, 10)
+		delegates.EmitEvent = func(ctx moleculer.BrokerContext) {
+			emitted <- ctx
+		}
+		bkrContext := context.BrokerContext(delegates)
+
+		It("should listen over TLS when certFile and keyFile are provided", func() {
+			folder, err := ioutil.TempDir("", "gateway-tls")
+			Expect(err).Should(Succeed())
+			defer os.RemoveAll(folder)
+			certFile, keyFile := selfSignedCert(folder)
+
+			svc := &HttpService{settings: map[string]interface{}{
+				"ip":   "localhost",
+				"port": "3564",
+				"tls": map[string]interface{}{
+					"certFile": certFile,
+					"keyFile":  keyFile,
+				},
+			}}
+			svc.server = &http.Server{Addr: svc.getAddress(), Handler: okHandler}
+			go svc.startServer(bkrContext)
+			defer svc.shutdownServer()
+
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}}
+			Eventually(func() error {
+				_, err := client.Get("https://localhost:3564/")
+				return err
+			}).Should(Succeed())
+			response, err := client.Get("https://localhost:3564/")
+			Expect(err).Should(Succeed())
+			Expect(response.TLS).ShouldNot(BeNil())
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+		})
+
+		It("should listen on the configured tcp4 network", func() {
+			svc := &HttpService{settings: map[string]interface{}{
+				"ip":      "127.0.0.1",
+				"port":    "3566",
+				"network": "tcp4",
+			}}
+			svc.server = &http.Server{Handler: okHandler}
+			go svc.startServer(bkrContext)
+			defer svc.shutdownServer()
+
+			Eventually(func() error {
+				_, err := http.Get("http://127.0.0.1:3566/")
+				return err
+			}).Should(Succeed())
+		})
+
+		It("should emit $gateway.listening with the bound address before serving", func() {
+			svc := &HttpService{settings: map[string]interface{}{
+				"ip":   "127.0.0.1",
+				"port": "3567",
+			}}
+			svc.server = &http.Server{Handler: okHandler}
+			go svc.startServer(bkrContext)
+			defer svc.shutdownServer()
+
+			var event moleculer.BrokerContext
+			Eventually(emitted).Should(Receive(&event))
+			for event.EventName() != "$gateway.listening" || event.Payload().Get("address").String() != "127.0.0.1:3567" {
+				Eventually(emitted).Should(Receive(&event))
+			}
+			Expect(event.Payload().Get("network").String()).Should(Equal("tcp"))
+			_, err := http.Get("http://127.0.0.1:3567/")
+			Expect(err).Should(Succeed())
+		})
+
+		It("should listen on a unix socket", func() {
+			folder, err := ioutil.TempDir("", "gateway-socket")
+			Expect(err).Should(Succeed())
+			defer os.RemoveAll(folder)
+			socket := filepath.Join(folder, "gateway.sock")
+
+			svc := &HttpService{settings: map[string]interface{}{
+				"network": "unix",
+				"socket":  socket,
+			}}
+			svc.server = &http.Server{Handler: okHandler}
+			go svc.startServer(bkrContext)
+			defer svc.shutdownServer()
+
+			client := &http.Client{Transport: &http.Transport{
+				Dial: func(network, address string) (net.Conn, error) {
+					return net.Dial("unix", socket)
+				},
+			}}
+			Eventually(func() error {
+				_, err := client.Get("http://unix/")
+				return err
+			}).Should(Succeed())
+		})
+
+		It("should listen over plain HTTP when tls settings are missing", func() {
+			svc := &HttpService{settings: map[string]interface{}{
+				"ip":   "localhost",
+				"port": "3565",
+			}}
+			svc.server = &http.Server{Addr: svc.getAddress(), Handler: okHandler}
+			go svc.startServer(bkrContext)
+			defer svc.shutdownServer()
+
+			Eventually(func() error {
+				_, err := http.Get("http://localhost:3565/")
+				return err
+			}).Should(Succeed())
+		})
+	})
+
+	It("durationSetting should accept durations and duration strings", func() {
+		settings := map[string]interface{}{
+			"duration": 5 * time.Second,
+			"string":   "150ms",
+			"invalid":  "soon",
+		}
+		Expect(durationSetting(settings, "duration")).Should(Equal(5 * time.Second))
+		Expect(durationSetting(settings, "string")).Should(Equal(150 * time.Millisecond))
+		Expect(durationSetting(settings, "invalid")).Should(Equal(time.Duration(0)))
+		Expect(durationSetting(settings, "missing")).Should(Equal(time.Duration(0)))
+	})
+
+	Describe("sendReponse", func() {
+		request := httptest.NewRequest(http.MethodGet, "http://local/users/get", nil)
+
+		It("should convert result into JSON and send in the reponse with success status code", func() {
+			result := map[string]interface{}{
+				"name":     "John",
+				"lastName": "Snow",
+				"category": "Bastart",
+				"nilvalue": nil,
+			}
+
+			response := &mockReponseWriter{header: map[string][]string{}}
+			ah := actionHandler{}
+			ah.sendReponse(log.WithField("test", ""), request, payload.New(result), response)
+			json := response.String()
+			Expect(gjson.Get(json, "category").String()).Should(Equal("Bastart"))
+			Expect(gjson.Get(json, "lastName").String()).Should(Equal("Snow"))
+			Expect(gjson.Get(json, "name").String()).Should(Equal("John"))
+
+			Expect(response.statusCode).Should(Equal(succesStatusCode))
+			Expect(response.Header().Get("Content-Type")).Should(Equal("application/json"))
+		})
+
+		It("should convert error result into JSON and send in the reponse with error status code", func() {
+			response := &mockReponseWriter{header: map[string][]string{}}
+			ah := actionHandler{}
+			ah.sendReponse(log.WithField("test", ""), request, payload.New(errors.New("Some error...")), response)
+			json := response.String()
+			Expect(gjson.Get(json, "error").String()).Should(Equal("Some error..."))
+			Expect(response.statusCode).Should(Equal(errorStatusCode))
+			Expect(response.Header().Get("Content-Type")).Should(Equal("application/json"))
+		})
+
+		It("should include the name and code of a structured error", func() {
+			response := &mockReponseWriter{header: map[string][]string{}}
+			ah := actionHandler{}
+			result := payload.New(validationError{codeError{"Invalid email", http.StatusUnprocessableEntity}})
+			ah.sendReponse(log.WithField("test", ""), request, result, response)
+			Expect(response.statusCode).Should(Equal(http.StatusUnprocessableEntity))
+			Expect(response.String()).Should(Equal(`{"code":422,"error":"Invalid email","name":"ValidationError"}`))
+		})
+
+		It("should include a default name and the status code for plain errors", func() {
+			response := &mockReponseWriter{header: map[string][]string{}}
+			ah := actionHandler{}
+			ah.sendReponse(log.WithField("test", ""), request, payload.Error("Some error..."), response)
+			Expect(response.String()).Should(Equal(`{"code":500,"error":"Some error...","name":"MoleculerError"}`))
+
+			response = &mockReponseWriter{header: map[string][]string{}}
+			ah.sendReponse(log.WithField("test", ""), request, payload.New(statusError{"Gateway Timeout", http.StatusGatewayTimeout}), response)
+			Expect(gjson.Get(response.String(), "name").String()).Should(Equal("GatewayTimeoutError"))
+			Expect(gjson.Get(response.String(), "code").Int()).Should(Equal(int64(http.StatusGatewayTimeout)))
+
+			Expect(errorName(statusError{"failed", http.StatusInternalServerError})).Should(Equal("InternalServerError"))
+			Expect(errorName(statusError{"not found", http.StatusNotFound})).Should(Equal("NotFoundError"))
+		})
+
+		It("should wrap errors in the envelope when errorEnvelope is true", func() {
+			response := &mockReponseWriter{header: map[string][]string{}}
+			ah := actionHandler{settings: map[string]interface{}{"errorEnvelope": true}}
+			ah.sendReponse(log.WithField("test", ""), request, payload.New(statusError{"User not found", http.StatusNotFound}), response)
+			json := response.String()
+			Expect(gjson.Get(json, "error.message").String()).Should(Equal("User not found"))
+			Expect(gjson.Get(json, "error.code").Int()).Should(Equal(int64(http.StatusNotFound)))
+			Expect(gjson.Get(json, "error.type").String()).Should(Equal("Not Found"))
+			Expect(gjson.Get(json, "error.name").String()).Should(Equal("NotFoundError"))
+			Expect(response.statusCode).Should(Equal(http.StatusNotFound))
+
+			response = &mockReponseWriter{header: map[string][]string{}}
+			ah = actionHandler{settings: map[string]interface{}{"errorEnvelope": func(err error, code int) interface{} {
+				return map[string]interface{}{"failure": err.Error(), "status": code}
+			}}}
+			ah.sendReponse(log.WithField("test", ""), request, payload.New(errors.New("Some error...")), response)
+			Expect(response.String()).Should(Equal(`{"failure":"Some error...","status":500}`))
+		})
+
+		It("should wrap the errors of the middlewares in the envelope", func() {
+			auth := map[string]interface{}{
+				"bearer": func(token string) (moleculer.Payload, error) {
+					return payload.Empty(), nil
+				},
+			}
+			handler := bearerMiddleware(map[string]interface{}{"errorEnvelope": true, "auth": auth}, okHandler)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			json := response.Body.String()
+			Expect(response.Code).Should(Equal(http.StatusUnauthorized))
+			Expect(gjson.Get(json, "error.message").String()).Should(Equal("Missing Bearer token"))
+			Expect(gjson.Get(json, "error.code").Int()).Should(Equal(int64(http.StatusUnauthorized)))
+			Expect(gjson.Get(json, "error.name").String()).Should(Equal("UnauthorizedError"))
+
+			envelope := func(err error, code int) interface{} {
+				return map[string]interface{}{"failure": err.Error(), "status": code}
+			}
+			handler = rateLimitMiddleware(map[string]interface{}{
+				"errorEnvelope": envelope,
+				"rateLimit":     map[string]interface{}{"requestsPerSecond": 1, "burst": 1},
+			}, okHandler)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			Expect(response.Body.String()).Should(Equal(`{"failure":"Too Many Requests","status":429}`))
+
+			response = httptest.NewRecorder()
+			sendError(map[string]interface{}{"errorEnvelope": false}, response, http.StatusBadGateway, "Bad Gateway")
+			Expect(response.Body.String()).Should(Equal(`{"error":"Bad Gateway"}`))
+		})
+
+		It("should wrap results in {data} when successEnvelope is true", func() {
+			response := &mockReponseWriter{header: map[string][]string{}}
+			ah := actionHandler{settings: map[string]interface{}{"successEnvelope": true}}
+			ah.sendReponse(log.WithField("test", ""), request, payload.New(map[string]interface{}{"name": "John"}), response)
+			Expect(gjson.Get(response.String(), "data.name").String()).Should(Equal("John"))
+			Expect(response.statusCode).Should(Equal(succesStatusCode))
+		})
+
+		It("should replace a previously set Content-Type instead of adding a second one", func() {
+			response := &mockReponseWriter{header: map[string][]string{
+				"Content-Type": []string{"text/plain; charset=utf-8"},
+			}}
+			ah := actionHandler{}
+			ah.sendReponse(log.WithField("test", ""), request, payload.New("value"), response)
+			Expect(response.Header()["Content-Type"]).Should(Equal([]string{"application/json"}))
+
+			response = &mockReponseWriter{header: map[string][]string{
+				"Content-Type": []string{"text/plain; charset=utf-8"},
+			}}
+			ah.sendReponse(log.WithField("test", ""), request, payload.New(errors.New("Some error...")), response)
+			Expect(response.Header()["Content-Type"]).Should(Equal([]string{"application/json"}))
+		})
+
+		It("should serialize with msgpack when the Accept header asks for it", func() {
+			result := payload.Empty().Add("name", "John").Add("tags", []interface{}{"stark", "snow"}).Add("address", payload.Empty().Add("city", "Winterfell"))
+			msgpackRequest := httptest.NewRequest(http.MethodGet, "http://local/users/get", nil)
+			msgpackRequest.Header.Set("Accept", "application/msgpack")
+			response := &mockReponseWriter{header: map[string][]string{}}
+			ah := actionHandler{}
+			ah.sendReponse(log.WithField("test", ""), msgpackRequest, result, response)
+			Expect(response.statusCode).Should(Equal(succesStatusCode))
+			Expect(response.Header().Get("Content-Type")).Should(Equal("application/msgpack"))
+
+			var decoded map[string]interface{}
+			Expect(msgpack.Unmarshal(response.buffer, &decoded)).Should(Succeed())
+			Expect(decoded["name"]).Should(Equal("John"))
+			Expect(decoded["tags"]).Should(Equal([]interface{}{"stark", "snow"}))
+			Expect(decoded["address"]).Should(Equal(map[string]interface{}{"city": "Winterfell"}))
+
+			response = &mockReponseWriter{header: map[string][]string{}}
+			ah.sendReponse(log.WithField("test", ""), msgpackRequest, payload.New(errors.New("Some error...")), response)
+			Expect(response.statusCode).Should(Equal(errorStatusCode))
+			Expect(msgpack.Unmarshal(response.buffer, &decoded)).Should(Succeed())
+			Expect(decoded["error"]).Should(Equal("Some error..."))
+		})
+
+		It("should serialize with XML when the Accept header prefers it", func() {
+			result := payload.Empty().Add("name", "John & Sons").Add("tags", []interface{}{"stark", "snow"}).Add("address", payload.Empty().Add("city", "Winterfell"))
+			xmlRequest := httptest.NewRequest(http.MethodGet, "http://local/users/get", nil)
+			xmlRequest.Header.Set("Accept", "application/xml")
+			response := &mockReponseWriter{header: map[string][]string{}}
+			ah := actionHandler{}
+			ah.sendReponse(log.WithField("test", ""), xmlRequest, result, response)
+			Expect(response.statusCode).Should(Equal(succesStatusCode))
+			Expect(response.Header().Get("Content-Type")).Should(Equal("application/xml"))
+			Expect(response.String()).Should(Equal(xml.Header + "<response><address><city>Winterfell</city></address><name>John &amp; Sons</name><tags><item>stark</item><item>snow</item></tags></response>"))
+
+			var decoded struct {
+				Name string   `xml:"name"`
+				City string   `xml:"address>city"`
+				Tags []string `xml:"tags>item"`
+			}
+			Expect(xml.Unmarshal(response.buffer, &decoded)).Should(Succeed())
+			Expect(decoded.Name).Should(Equal("John & Sons"))
+			Expect(decoded.City).Should(Equal("Winterfell"))
+			Expect(decoded.Tags).Should(Equal([]string{"stark", "snow"}))
+
+			response = &mockReponseWriter{header: map[string][]string{}}
+			ah.sendReponse(log.WithField("test", ""), xmlRequest, payload.New(errors.New("Some error...")), response)
+			Expect(response.statusCode).Should(Equal(errorStatusCode))
+			Expect(response.String()).Should(Equal(xml.Header + "<response><code>500</code><error>Some error...</error><name>MoleculerError</name></response>"))
+		})
+
+		It("should use the serializer from settings for the request and the response", func() {
+			stub := &stubSerializer{}
+			settings := map[string]interface{}{"serializer": stub}
+			request := httptest.NewRequest(http.MethodPost, "http://local/users/create", strings.NewReader("John"))
+			params := paramsFromRequest(request, settings, log.WithField("unit", "test"))
+			Expect(stub.parsed).Should(Equal([]string{"John"}))
+			Expect(params.Get("name").String()).Should(Equal("John"))
+
+			response := &mockReponseWriter{header: map[string][]string{}}
+			ah := actionHandler{settings: settings}
+			ah.sendReponse(log.WithField("test", ""), request, params, response)
+			Expect(response.statusCode).Should(Equal(succesStatusCode))
+			Expect(response.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Expect(response.String()).Should(Equal("name=John"))
+		})
+
+		It("should keep JSON when XML is not the preferred media type", func() {
+			browserRequest := httptest.NewRequest(http.MethodGet, "http://local/users/get", nil)
+			browserRequest.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+			response := &mockReponseWriter{header: map[string][]string{}}
+			ah := actionHandler{}
+			ah.sendReponse(log.WithField("test", ""), browserRequest, payload.Empty().Add("name", "John"), response)
+			Expect(response.Header().Get("Content-Type")).Should(Equal("application/json"))
+		})
+
+		It("should not log the response data when logResponseData is nil", func() {
+			logger, hook := logtest.NewNullLogger()
+			logger.SetLevel(log.TraceLevel)
+			ah := actionHandler{action: "users.get", settings: map[string]interface{}{"logResponseData": nil}}
+			ah.sendReponse(log.NewEntry(logger), request, payload.Empty().Add("name", "John"), &mockReponseWriter{header: map[string][]string{}})
+			for _, entry := range hook.AllEntries() {
+				Expect(entry.Message).ShouldNot(ContainSubstring("John"))
+			}
+		})
+
+		It("should log the response data at the logResponseData level", func() {
+			logger, hook := logtest.NewNullLogger()
+			ah := actionHandler{action: "users.get", settings: map[string]interface{}{"logResponseData": "info"}}
+			ah.sendReponse(log.NewEntry(logger), request, payload.Empty().Add("name", "John"), &mockReponseWriter{header: map[string][]string{}})
+			Expect(hook.Entries).Should(HaveLen(1))
+			Expect(hook.LastEntry().Level).Should(Equal(log.InfoLevel))
+			Expect(hook.LastEntry().Message).Should(ContainSubstring(`{"name":"John"}`))
+		})
+
+		It("should keep JSON when the Accept header does not ask for msgpack", func() {
+			jsonRequest := httptest.NewRequest(http.MethodGet, "http://local/users/get", nil)
+			jsonRequest.Header.Set("Accept", "application/json, text/plain")
+			response := &mockReponseWriter{header: map[string][]string{}}
+			ah := actionHandler{}
+			ah.sendReponse(log.WithField("test", ""), jsonRequest, payload.Empty().Add("name", "John"), response)
+			Expect(response.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Expect(gjson.Get(response.String(), "name").String()).Should(Equal("John"))
+		})
+	})
+
+	Describe("statusCodeFromError", func() {
+		request := httptest.NewRequest(http.MethodGet, "http://local/users/get", nil)
+
+		It("should use the error code when it is a valid HTTP error status", func() {
+			notFound := payload.New(codeError{"Not found", 404})
+			Expect(statusCodeFromError(notFound)).Should(Equal(404))
+
+			response := &mockReponseWriter{header: map[string][]string{}}
+			ah := actionHandler{}
+			ah.sendReponse(log.WithField("test", ""), request, notFound, response)
+			Expect(response.statusCode).Should(Equal(404))
+			Expect(gjson.Get(response.String(), "error").String()).Should(Equal("Not found"))
+		})
+
+		It("should fallback to the default error status code", func() {
+			Expect(statusCodeFromError(payload.New(errors.New("Some error...")))).Should(Equal(errorStatusCode))
+			Expect(statusCodeFromError(payload.New(codeError{"Weird code", 42}))).Should(Equal(errorStatusCode))
+			Expect(statusCodeFromError(payload.New(codeError{"Redirect", 302}))).Should(Equal(errorStatusCode))
+		})
+	})
+
+	Describe("streamResponse", func() {
+		It("should stream io.Reader results directly to the response", func() {
+			content := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+			ctx, _ := mockActionContext(bytes.NewReader(content))
+			handler := actionHandler{action: "files.download", context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/files/download", nil))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(response.Header().Get("Content-Type")).Should(Equal("application/octet-stream"))
+			Expect(response.Flushed).Should(BeTrue())
+			Expect(response.Body.Len()).Should(Equal(len(content)))
+			Expect(bytes.Equal(response.Body.Bytes(), content)).Should(BeTrue())
+		})
+	})
+
+	Describe("paramsFromRequest", func() {
+
+		It("should get params from the URL", func() {
+			parsedUrl, _ := url.Parse("http://local/path?force=false&name=John&actions=first&actions=second")
+			request := &http.Request{
+				URL: parsedUrl,
+			}
+
+			payload := paramsFromRequest(request, map[string]interface{}{}, log.WithField("unit", "test"))
+			Expect(payload.Get("force").Exists()).Should(BeTrue())
+			Expect(payload.Get("force").Bool()).Should(BeFalse())
+
+			Expect(payload.Get("name").Exists()).Should(BeTrue())
+			Expect(payload.Get("name").String()).Should(Equal("John"))
+
+			Expect(payload.Get("actions").Exists()).Should(BeTrue())
+			Expect(payload.Get("actions").StringArray()).Should(Equal([]string{"first", "second"}))
+
+		})
+
+		It("should nest the form params in bracket notation", func() {
+			bodyIo := strings.NewReader(`filter[status]=active&filter[type]=a&filter[range][from]=1&name=John`)
+			request := httptest.NewRequest("POST", "http://local/path", bodyIo)
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			params := paramsFromRequest(request, map[string]interface{}{}, log.WithField("unit", "test"))
+			Expect(params.Get("filter").RawMap()).Should(Equal(map[string]interface{}{
+				"status": "active",
+				"type":   "a",
+				"range":  map[string]interface{}{"from": "1"},
+			}))
+			Expect(params.Get("name").String()).Should(Equal("John"))
+			Expect(params.Get("filter[status]").Exists()).Should(BeFalse())
+		})
+
+		It("should collect the form params with [] into arrays", func() {
+			bodyIo := strings.NewReader(`tags[]=x&tags[]=y&single[]=z&user[roles][]=admin`)
+			request := httptest.NewRequest("POST", "http://local/path", bodyIo)
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			params := paramsFromRequest(request, map[string]interface{}{}, log.WithField("unit", "test"))
+			Expect(params.Get("tags").Value()).Should(Equal([]interface{}{"x", "y"}))
+			Expect(params.Get("single").Value()).Should(Equal([]interface{}{"z"}))
+			Expect(params.Get("user").Get("roles").Value()).Should(Equal([]interface{}{"admin"}))
+		})
+
+		It("should keep names that are not in bracket notation", func() {
+			Expect(bracketKeys("name")).Should(Equal([]string{"name"}))
+			Expect(bracketKeys("[name]")).Should(Equal([]string{"[name]"}))
+			Expect(bracketKeys("a[b")).Should(Equal([]string{"a[b"}))
+			Expect(bracketKeys("a[b][c]")).Should(Equal([]string{"a", "b", "c"}))
+			Expect(bracketKeys("a[]")).Should(Equal([]string{"a", ""}))
+		})
+
+		It("should get params from the body and URL", func() {
+			bodyIo := strings.NewReader(`name=Janet&age=47`)
+			request := httptest.NewRequest("POST", "http://local/path?forced=maybe", bodyIo)
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			payload := paramsFromRequest(request, map[string]interface{}{}, log.WithField("unit", "test"))
+
+			Expect(payload.Get("forced").Exists()).Should(BeTrue())
+			Expect(payload.Get("forced").String()).Should(Equal("maybe"))
+
+			Expect(payload.Get("age").Exists()).Should(BeTrue())
+			Expect(payload.Get("age").Int()).Should(Equal(47))
+
+			Expect(payload.Get("name").Exists()).Should(BeTrue())
+			Expect(payload.Get("name").String()).Should(Equal("Janet"))
+		})
+
+		It("should merge query params with a JSON body", func() {
+			bodyIo := strings.NewReader(`{"name":"Janet","age":47}`)
+			request := httptest.NewRequest("POST", "http://local/path?forced=maybe&limit=10", bodyIo)
+			request.Header.Set("Content-Type", "application/json")
+
+			payload := paramsFromRequest(request, map[string]interface{}{}, log.WithField("unit", "test"))
+
+			Expect(payload.Get("forced").String()).Should(Equal("maybe"))
+			Expect(payload.Get("limit").Int()).Should(Equal(10))
+			Expect(payload.Get("name").String()).Should(Equal("Janet"))
+			Expect(payload.Get("age").Int()).Should(Equal(47))
+		})
+
+		It("should expose uploaded files from multipart forms", func() {
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			Expect(writer.WriteField("title", "My file")).Should(Succeed())
+			part, err := writer.CreateFormFile("upload", "hello.txt")
+			Expect(err).Should(Succeed())
+			part.Write([]byte("Hello World!"))
+			Expect(writer.Close()).Should(Succeed())
+
+			var params moleculer.Payload
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				params = ctx.Payload()
+				return "uploaded"
+			})
+			handler := actionHandler{action: "files.upload", settings: map[string]interface{}{"maxUploadSize": 1024}, context: ctx}
+			request := httptest.NewRequest(http.MethodPost, "http://local/files/upload?folder=docs", body)
+			request.Header.Set("Content-Type", writer.FormDataContentType())
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+
+			Expect(response.Body.String()).Should(Equal("uploaded"))
+			Expect(params.Get("title").String()).Should(Equal("My file"))
+			Expect(params.Get("folder").String()).Should(Equal("docs"))
+			file := params.Get("files").Get("upload")
+			Expect(file.Get("filename").String()).Should(Equal("hello.txt"))
+			Expect(file.Get("size").Int()).Should(Equal(12))
+			Expect(string(file.Get("bytes").ByteArray())).Should(Equal("Hello World!"))
+		})
+
+		It("should respond 413 to multipart forms over maxUploadSize", func() {
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			part, err := writer.CreateFormFile("upload", "large.txt")
+			Expect(err).Should(Succeed())
+			part.Write(bytes.Repeat([]byte("x"), 4096))
+			Expect(writer.Close()).Should(Succeed())
+
+			ctx, calls := mockActionContext("uploaded")
+			handler := actionHandler{action: "files.upload", settings: map[string]interface{}{"maxUploadSize": 1024}, context: ctx}
+			request := httptest.NewRequest(http.MethodPost, "http://local/files/upload", body)
+			request.Header.Set("Content-Type", writer.FormDataContentType())
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(http.StatusRequestEntityTooLarge))
+			Expect(*calls).Should(Equal(0))
+		})
+
+		It("body params should take precedence over query params", func() {
+			bodyIo := strings.NewReader(`{"name":"Janet"}`)
+			request := httptest.NewRequest("POST", "http://local/path?name=John", bodyIo)
+			payload := paramsFromRequest(request, map[string]interface{}{}, log.WithField("unit", "test"))
+			Expect(payload.Get("name").String()).Should(Equal("Janet"))
+
+			bodyIo = strings.NewReader(`name=Janet`)
+			request = httptest.NewRequest("POST", "http://local/path?name=John", bodyIo)
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			payload = paramsFromRequest(request, map[string]interface{}{}, log.WithField("unit", "test"))
+			Expect(payload.Get("name").String()).Should(Equal("Janet"))
+		})
+
+		It("should parse msgpack bodies using the Content-Type header", func() {
+			body, _ := msgpack.Marshal(map[string]interface{}{"name": "Janet", "age": 30})
+			request := httptest.NewRequest("POST", "http://local/path?limit=10", bytes.NewReader(body))
+			request.Header.Set("Content-Type", "application/msgpack")
+			payload := paramsFromRequest(request, map[string]interface{}{}, log.WithField("unit", "test"))
+			Expect(payload.IsError()).Should(BeFalse())
+			Expect(payload.Get("name").String()).Should(Equal("Janet"))
+			Expect(payload.Get("age").Int()).Should(Equal(30))
+			Expect(payload.Get("limit").String()).Should(Equal("10"))
+		})
+
+		It("should pass msgpack and form bodies to the action", func() {
+			var params moleculer.Payload
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				params = ctx.Payload()
+				return "created"
+			})
+			handler := actionHandler{action: "users.create", context: ctx}
+
+			body, _ := msgpack.Marshal(map[string]interface{}{"name": "Janet"})
+			request := httptest.NewRequest(http.MethodPost, "http://local/users/create", bytes.NewReader(body))
+			request.Header.Set("Content-Type", "application/x-msgpack")
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			Expect(params.Get("name").String()).Should(Equal("Janet"))
+
+			request = httptest.NewRequest(http.MethodPost, "http://local/users/create", strings.NewReader("name=John"))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			Expect(params.Get("name").String()).Should(Equal("John"))
+		})
+
+		It("should return an error for an invalid msgpack body", func() {
+			request := httptest.NewRequest("POST", "http://local/path", strings.NewReader("\xc1"))
+			request.Header.Set("Content-Type", "application/msgpack")
+			payload := paramsFromRequest(request, map[string]interface{}{}, log.WithField("unit", "test"))
+			Expect(payload.IsError()).Should(BeTrue())
+		})
+
+		It("should log the params at the logRequestParams level", func() {
+			logger, hook := logtest.NewNullLogger()
+			logger.SetLevel(log.DebugLevel)
+			request := httptest.NewRequest("POST", "http://local/path?limit=10", strings.NewReader(`{"name":"Janet"}`))
+			paramsFromRequest(request, map[string]interface{}{"logRequestParams": "debug"}, log.NewEntry(logger))
+			Expect(hook.Entries).Should(HaveLen(1))
+			Expect(hook.LastEntry().Level).Should(Equal(log.DebugLevel))
+			Expect(hook.LastEntry().Message).Should(ContainSubstring("name:Janet"))
+			Expect(hook.LastEntry().Message).Should(ContainSubstring("limit:10"))
+		})
+
+		It("should not log the params when logRequestParams is nil", func() {
+			logger, hook := logtest.NewNullLogger()
+			logger.SetLevel(log.TraceLevel)
+			request := httptest.NewRequest("POST", "http://local/path?limit=10", strings.NewReader(`{"name":"Janet"}`))
+			paramsFromRequest(request, map[string]interface{}{"logRequestParams": nil}, log.NewEntry(logger))
+			Expect(hook.Entries).Should(BeEmpty())
+		})
+
+		It("should read bodies under the maxBodySize limit", func() {
+			settings := map[string]interface{}{"maxBodySize": 64}
+			request := httptest.NewRequest("POST", "http://local/path", strings.NewReader(`{"name":"Janet"}`))
+			payload := paramsFromRequest(request, settings, log.WithField("unit", "test"))
+			Expect(payload.IsError()).Should(BeFalse())
+			Expect(payload.Get("name").String()).Should(Equal("Janet"))
+		})
+
+		It("should return a 413 error for bodies over the maxBodySize limit", func() {
+			settings := map[string]interface{}{"maxBodySize": 64}
+			largeBody := `{"name":"` + strings.Repeat("J", 100) + `"}`
+			request := httptest.NewRequest("POST", "http://local/path", strings.NewReader(largeBody))
+			payload := paramsFromRequest(request, settings, log.WithField("unit", "test"))
+			Expect(payload.IsError()).Should(BeTrue())
+			Expect(statusCodeFromError(payload)).Should(Equal(http.StatusRequestEntityTooLarge))
+
+			request = httptest.NewRequest("POST", "http://local/path", strings.NewReader("name="+strings.Repeat("J", 100)))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			payload = paramsFromRequest(request, settings, log.WithField("unit", "test"))
+			Expect(statusCodeFromError(payload)).Should(Equal(http.StatusRequestEntityTooLarge))
+		})
+
+		It("should return a 400 error for malformed JSON bodies", func() {
+			request := httptest.NewRequest("POST", "http://local/path", strings.NewReader(`{"name":`))
+			request.Header.Set("Content-Type", "application/json")
+			payload := paramsFromRequest(request, map[string]interface{}{}, log.WithField("unit", "test"))
+			Expect(payload.IsError()).Should(BeTrue())
+			Expect(statusCodeFromError(payload)).Should(Equal(http.StatusBadRequest))
+
+			request = httptest.NewRequest("POST", "http://local/path", bytes.NewReader([]byte{0xc1}))
+			request.Header.Set("Content-Type", "application/msgpack")
+			payload = paramsFromRequest(request, map[string]interface{}{}, log.WithField("unit", "test"))
+			Expect(statusCodeFromError(payload)).Should(Equal(http.StatusBadRequest))
+		})
+
+		It("should respond 400 without calling the action when the JSON body is malformed", func() {
+			ctx, calls := mockActionContext("created")
+			handler := actionHandler{action: "users.create", context: ctx}
+			request := httptest.NewRequest(http.MethodPost, "http://local/users/create", strings.NewReader(`{"name": "John"`))
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(*calls).Should(Equal(0))
+			Expect(response.Code).Should(Equal(http.StatusBadRequest))
+			Expect(gjson.Get(response.Body.String(), "error").String()).Should(ContainSubstring("invalid JSON"))
+		})
+
+		It("should respond 413 without calling the action when the body is over the limit", func() {
+			ctx, calls := mockActionContext("created")
+			handler := actionHandler{action: "users.create", settings: map[string]interface{}{"maxBodySize": 64}, context: ctx}
+			request := httptest.NewRequest(http.MethodPost, "http://local/users/create", strings.NewReader(strings.Repeat("J", 100)))
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(*calls).Should(Equal(0))
+			Expect(response.Code).Should(Equal(http.StatusRequestEntityTooLarge))
+		})
+
+	})
+
+	It("acceptedMethods should return accept methodscoming from the alias", func() {
+		handler := actionHandler{alias: "GET users"}
+		Expect(handler.acceptedMethods()).Should(BeEquivalentTo(map[string]bool{
+			"GET": true,
+		}))
+
+		handler = actionHandler{alias: "POST users"}
+		Expect(handler.acceptedMethods()).Should(BeEquivalentTo(map[string]bool{
+			"POST": true,
+		}))
+
+		handler = actionHandler{alias: "PUT some/path/big"}
+		Expect(handler.acceptedMethods()).Should(BeEquivalentTo(map[string]bool{
+			"PUT": true,
+		}))
+
+		handler = actionHandler{alias: "DELETE two/paths"}
+		Expect(handler.acceptedMethods()).Should(BeEquivalentTo(map[string]bool{
+			"DELETE": true,
+		}))
+
+		handler = actionHandler{alias: "PATCH users/update"}
+		Expect(handler.acceptedMethods()).Should(BeEquivalentTo(map[string]bool{
+			"PATCH": true,
+		}))
+
+		handler = actionHandler{alias: "GET|post users"}
+		Expect(handler.acceptedMethods()).Should(BeEquivalentTo(map[string]bool{
+			"GET":  true,
+			"POST": true,
+		}))
+		Expect(handler.aliasPath()).Should(Equal("users"))
+
+		handler = actionHandler{alias: "two/paths"}
+		Expect(handler.acceptedMethods()).Should(BeEquivalentTo(map[string]bool{
+			"GET":    true,
+			"POST":   true,
+			"PUT":    true,
+			"DELETE": true,
+			"PATCH":  true,
+		}))
+	})
+
+	Describe("ServeHTTP", func() {
+
+		It("should invoke the action for a PATCH request on a default handler", func() {
+			ctx, calls := mockActionContext("patched")
+			handler := actionHandler{action: "users.patch", context: ctx}
+			request := httptest.NewRequest(http.MethodPatch, "http://local/users/patch", strings.NewReader(`{"name":"John"}`))
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(*calls).Should(Equal(1))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(response.Body.String()).Should(Equal("patched"))
+		})
+
+		It("should invoke the action for a PATCH request on a PATCH alias", func() {
+			ctx, calls := mockActionContext("patched")
+			handler := actionHandler{alias: "PATCH update", action: "users.patch", context: ctx}
+			request := httptest.NewRequest(http.MethodPatch, "http://local/update", strings.NewReader(`{"name":"John"}`))
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(*calls).Should(Equal(1))
+			Expect(response.Body.String()).Should(Equal("patched"))
+		})
+
+		It("should answer HEAD like GET without a body", func() {
+			ctx, calls := mockActionContext(map[string]interface{}{"name": "John"})
+			handler := actionHandler{action: "users.get", context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodHead, "http://local/users/get", nil))
+			Expect(*calls).Should(Equal(1))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(response.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Expect(response.Header().Get("Content-Length")).Should(Equal("15"))
+			Expect(response.Body.Len()).Should(Equal(0))
+		})
+
+		It("should respond 405 with the Allow header for invalid methods", func() {
+			ctx, calls := mockActionContext("result")
+			handler := actionHandler{alias: "GET users", action: "users.list", context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodTrace, "http://local/users", nil))
+			Expect(*calls).Should(Equal(0))
+			Expect(response.Code).Should(Equal(http.StatusMethodNotAllowed))
+			Expect(response.Header().Get("Allow")).Should(Equal("GET, HEAD"))
+			Expect(gjson.Get(response.Body.String(), "error").String()).Should(Equal("Invalid HTTP Method - accepted methods: GET, HEAD"))
+		})
+
+		It("should respond 405 for valid methods not accepted by the alias", func() {
+			ctx, calls := mockActionContext("result")
+			handler := actionHandler{alias: "PUT users", action: "users.update", context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users", nil))
+			Expect(*calls).Should(Equal(0))
+			Expect(response.Code).Should(Equal(http.StatusMethodNotAllowed))
+			Expect(response.Header().Get("Allow")).Should(Equal("PUT"))
+
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodHead, "http://local/users", nil))
+			Expect(*calls).Should(Equal(0))
+			Expect(response.Code).Should(Equal(http.StatusMethodNotAllowed))
+
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodPut, "http://local/users", nil))
+			Expect(*calls).Should(Equal(1))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+		})
+
+		It("should accept every method of a multi method alias and reject the others", func() {
+			ctx, calls := mockActionContext("result")
+			handler := actionHandler{alias: "GET|POST users", action: "users.list", context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users", nil))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "http://local/users", nil))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(*calls).Should(Equal(2))
+
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodDelete, "http://local/users", nil))
+			Expect(*calls).Should(Equal(2))
+			Expect(response.Code).Should(Equal(http.StatusMethodNotAllowed))
+			Expect(response.Header().Get("Allow")).Should(Equal("GET, HEAD, POST"))
+		})
+
+		It("should pass the X-Request-ID header to the action meta and echo it in the response", func() {
+			var meta moleculer.Payload
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				meta = ctx.Meta()
+				return "result"
+			})
+			handler := actionHandler{action: "users.list", context: ctx}
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+			request.Header.Set("X-Request-ID", "request-123")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(meta.Get("requestID").String()).Should(Equal("request-123"))
+			Expect(response.Header().Get("X-Request-ID")).Should(Equal("request-123"))
+		})
+
+		It("should pass the passHeaders to the action meta", func() {
+			var meta moleculer.Payload
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				meta = ctx.Meta()
+				return "result"
+			})
+			settings := map[string]interface{}{"passHeaders": []string{"Accept-Language", "X-Tenant"}}
+			handler := actionHandler{action: "users.list", settings: settings, context: ctx}
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+			request.Header.Set("Accept-Language", "pt-BR")
+			request.Header.Set("Authorization", "Bearer secret")
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			Expect(meta.Get("headers").RawMap()).Should(Equal(map[string]interface{}{"Accept-Language": "pt-BR"}))
+
+			route := map[string]interface{}{"passHeaders": []string{"X-Tenant"}}
+			handler = actionHandler{action: "users.list", route: route, settings: settings, context: ctx}
+			request.Header.Set("X-Tenant", "acme")
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			Expect(meta.Get("headers").RawMap()).Should(Equal(map[string]interface{}{"X-Tenant": "acme"}))
+		})
+
+		It("should not leak the meta of a request into the next requests", func() {
+			var meta moleculer.Payload
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				meta = ctx.Meta()
+				return "result"
+			})
+			route := map[string]interface{}{"authorization": true}
+			settings := map[string]interface{}{
+				"passHeaders": []string{"X-Tenant"},
+				"authorize": func(ctx moleculer.Context, route map[string]interface{}, request *http.Request) (moleculer.Payload, error) {
+					if request.Header.Get("Authorization") == "Bearer alice" {
+						return payload.New(map[string]interface{}{"name": "alice"}), nil
+					}
+					return nil, nil
+				},
+			}
+			handler := actionHandler{action: "users.list", route: route, settings: settings, context: ctx}
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+			request.Header.Set("Authorization", "Bearer alice")
+			request.Header.Set("X-Tenant", "acme")
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			Expect(meta.Get("user").Get("name").String()).Should(Equal("alice"))
+			Expect(meta.Get("headers").Get("X-Tenant").String()).Should(Equal("acme"))
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			Expect(meta.Get("user").Exists()).Should(BeFalse())
+			Expect(meta.Get("headers").Exists()).Should(BeFalse())
+			Expect(ctx.Meta().Get("user").Exists()).Should(BeFalse())
+		})
+
+		It("should generate a request id when the X-Request-ID header is absent", func() {
+			var meta moleculer.Payload
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				meta = ctx.Meta()
+				return "result"
+			})
+			handler := actionHandler{action: "users.list", context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			requestID := response.Header().Get("X-Request-ID")
+			Expect(requestID).Should(MatchRegexp(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`))
+			Expect(meta.Get("requestID").String()).Should(Equal(requestID))
+
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			Expect(response.Header().Get("X-Request-ID")).ShouldNot(Equal(requestID))
+		})
+
+		It("should send an ETag on GET responses and 304 when If-None-Match matches", func() {
+			ctx, calls := mockActionContext(map[string]interface{}{"name": "John"})
+			handler := actionHandler{action: "users.get", context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/get", nil))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(response.Body.String()).Should(Equal(`{"name":"John"}`))
+			etag := response.Header().Get("ETag")
+			Expect(etag).ShouldNot(BeEmpty())
+
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/get", nil)
+			request.Header.Set("If-None-Match", etag)
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(*calls).Should(Equal(2))
+			Expect(response.Code).Should(Equal(http.StatusNotModified))
+			Expect(response.Header().Get("ETag")).Should(Equal(etag))
+			Expect(response.Body.Len()).Should(Equal(0))
+
+			request = httptest.NewRequest(http.MethodGet, "http://local/users/get", nil)
+			request.Header.Set("If-None-Match", `"other"`)
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(succesStatusCode))
+
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "http://local/users/get", nil))
+			Expect(response.Header().Get("ETag")).Should(BeEmpty())
+		})
+
+		It("should add the route responseHeaders to the responses", func() {
+			ctx, _ := mockActionContext("result")
+			route := map[string]interface{}{"path": "/", "responseHeaders": map[string]string{
+				"Cache-Control":   "no-store",
+				"X-Frame-Options": "DENY",
+			}}
+			handler := actionHandler{action: "users.list", route: route, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(response.Header().Get("Cache-Control")).Should(Equal("no-store"))
+			Expect(response.Header().Get("X-Frame-Options")).Should(Equal("DENY"))
+
+			handler = actionHandler{action: "users.list", route: map[string]interface{}{"path": "/"}, context: ctx}
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			Expect(response.Header().Get("Cache-Control")).Should(Equal(""))
+		})
+
+		It("should log only the route logHeaders", func() {
+			logger, hook := logtest.NewNullLogger()
+			route := map[string]interface{}{"path": "/", "logHeaders": []string{"x-tenant", "User-Agent"}}
+			handler := actionHandler{action: "users.list", route: route}
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+			request.Header.Set("X-Tenant", "acme")
+			request.Header.Set("User-Agent", "test-agent")
+			request.Header.Set("Authorization", "Bearer secret-token")
+			request.Header.Set("Cookie", "session=secret")
+			handler.logHeaders(log.NewEntry(logger), request)
+
+			Expect(hook.Entries).Should(HaveLen(1))
+			Expect(hook.LastEntry().Data).Should(Equal(log.Fields{"X-Tenant": "acme", "User-Agent": "test-agent"}))
+			Expect(hook.LastEntry().Message).ShouldNot(ContainSubstring("secret"))
+
+			hook.Reset()
+			handler = actionHandler{action: "users.list", route: map[string]interface{}{"path": "/"}}
+			handler.logHeaders(log.NewEntry(logger), request)
+			Expect(hook.Entries).Should(BeEmpty())
+		})
+
+		It("should send the result as is with the contentType on raw routes", func() {
+			csv := "name,house\nJohn,Stark\nArya,Stark\n"
+			ctx, _ := mockActionContext(csv)
+			route := map[string]interface{}{"path": "/", "raw": true, "contentType": "text/csv"}
+			handler := actionHandler{action: "users.export", route: route, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/export", nil))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(response.Header().Get("Content-Type")).Should(Equal("text/csv"))
+			Expect(response.Body.String()).Should(Equal(csv))
+
+			ctx, _ = mockActionContext(errors.New("export failed"))
+			handler = actionHandler{action: "users.export", route: route, context: ctx}
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/export", nil))
+			Expect(response.Code).Should(Equal(errorStatusCode))
+			Expect(response.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Expect(gjson.Get(response.Body.String(), "error").String()).Should(Equal("export failed"))
+		})
+
+		It("should stream the payloads of an SSE alias as data frames", func() {
+			events := make(chan moleculer.Payload)
+			ctx, _ := mockActionContext(events)
+			handler := &actionHandler{alias: "SSE notifications", action: "notify.stream", context: ctx}
+			Expect(handler.pattern()).Should(Equal("/notifications"))
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			response, err := http.Get(server.URL + "/notifications")
+			Expect(err).Should(Succeed())
+			defer response.Body.Close()
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(response.Header.Get("Content-Type")).Should(Equal("text/event-stream"))
+
+			reader := bufio.NewReader(response.Body)
+			readFrame := func() string {
+				line, err := reader.ReadString('\n')
+				Expect(err).Should(Succeed())
+				blank, err := reader.ReadString('\n')
+				Expect(err).Should(Succeed())
+				Expect(blank).Should(Equal("\n"))
+				return line
+			}
+			events <- payload.New(map[string]interface{}{"id": 1})
+			Expect(readFrame()).Should(Equal("data: {\"id\":1}\n"))
+			events <- payload.New(map[string]interface{}{"id": 2})
+			Expect(readFrame()).Should(Equal("data: {\"id\":2}\n"))
+			close(events)
+			_, err = reader.ReadString('\n')
+			Expect(err).Should(Equal(io.EOF))
+		})
+
+		It("should bridge the messages of a WS alias with the action stream", func() {
+			closed := make(chan bool)
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				messages := ctx.Payload().Get("messages").Value().(<-chan moleculer.Payload)
+				room := ctx.Payload().Get("room").String()
+				replies := make(chan moleculer.Payload)
+				go func() {
+					for message := range messages {
+						replies <- payload.Empty().Add("room", room).Add("echo", message.Get("text").String())
+					}
+					close(replies)
+					close(closed)
+				}()
+				return replies
+			})
+			handler := &actionHandler{alias: "WS chat", action: "chat.connect", context: ctx}
+			Expect(handler.pattern()).Should(Equal("/chat"))
+			Expect(handler.acceptedMethods()).Should(Equal(map[string]bool{"GET": true}))
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/chat?room=general", nil)
+			Expect(err).Should(Succeed())
+			Expect(conn.WriteMessage(websocket.TextMessage, []byte(`{"text":"hello"}`))).Should(Succeed())
+			_, reply, err := conn.ReadMessage()
+			Expect(err).Should(Succeed())
+			Expect(string(reply)).Should(Equal(`{"echo":"hello","room":"general"}`))
+
+			conn.Close()
+			Eventually(closed).Should(BeClosed())
+		})
+
+		It("should respond with the error when the WS action fails", func() {
+			ctx, _ := mockActionContext(errors.New("chat closed"))
+			handler := actionHandler{alias: "WS chat", action: "chat.connect", context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/chat", nil))
+			Expect(response.Code).Should(Equal(errorStatusCode))
+			Expect(gjson.Get(response.Body.String(), "error").String()).Should(Equal("chat closed"))
+		})
+
+		It("should accept only GET on SSE aliases", func() {
+			ctx, calls := mockActionContext("result")
+			handler := actionHandler{alias: "SSE notifications", action: "notify.stream", context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "http://local/notifications", nil))
+			Expect(*calls).Should(Equal(0))
+			Expect(response.Code).Should(Equal(http.StatusMethodNotAllowed))
+
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/notifications", nil))
+			Expect(response.Body.String()).Should(Equal("data: result\n\n"))
+		})
+
+		It("should block the methods not in the global allowedMethods", func() {
+			ctx, calls := mockActionContext("result")
+			settings := map[string]interface{}{"allowedMethods": []string{"GET"}}
+			handler := actionHandler{alias: "POST users", action: "users.create", settings: settings, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "http://local/users", nil))
+			Expect(*calls).Should(Equal(0))
+			Expect(response.Code).Should(Equal(http.StatusMethodNotAllowed))
+
+			handler = actionHandler{action: "users.list", settings: settings, context: ctx}
+			Expect(allowHeader(handler.acceptedMethods())).Should(Equal("GET, HEAD"))
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodDelete, "http://local/users/list", nil))
+			Expect(response.Code).Should(Equal(http.StatusMethodNotAllowed))
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(*calls).Should(Equal(1))
+		})
+
+		It("should answer OPTIONS with the accepted methods without invoking the action", func() {
+			ctx, calls := mockActionContext("result")
+			handler := actionHandler{action: "users.list", context: ctx}
+			request := httptest.NewRequest(http.MethodOptions, "http://local/users/list", nil)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(*calls).Should(Equal(0))
+			Expect(response.Code).Should(Equal(http.StatusNoContent))
+			Expect(response.Header().Get("Allow")).Should(Equal("DELETE, GET, HEAD, PATCH, POST, PUT"))
+			Expect(response.Body.Len()).Should(Equal(0))
+
+			handler = actionHandler{alias: "GET users", action: "users.list", context: ctx}
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(*calls).Should(Equal(0))
+			Expect(response.Code).Should(Equal(http.StatusNoContent))
+			Expect(response.Header().Get("Allow")).Should(Equal("GET, HEAD"))
+
+			handler = actionHandler{alias: "POST users", action: "users.create", context: ctx}
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Header().Get("Allow")).Should(Equal("POST"))
+		})
+	})
+
+	It("invertStringMap should swap map keys/values", func() {
+		aliases := map[string]string{
+			"GET users":  "users.list",
+			"POST login": "auth.login",
+		}
+		inverted := invertStringMap(aliases)
+		Expect(inverted).Should(BeEquivalentTo(map[string]string{
+			"users.list": "GET users",
+			"auth.login": "POST login",
+		}))
+	})
+
+	Describe("createActionHandlers", func() {
+
+		It("should only create actions with alias", func() {
+			route := map[string]interface{}{
+				"path":          "/admin",
+				"mappingPolicy": "restrict",
+				"aliases": map[string]string{
+					"GET users": "user.list",
+					"login":     "auth.login",
+				},
+			}
+
+			actionHandlers := createActionHandlers(
+				route,
+				[]string{"user.list", "user.remove", "auth.login"},
+				log.WithField("unit", "test"),
+			)
+			Expect(len(actionHandlers)).Should(Equal(2))
+
+			Expect(actionHandlers[0].action).Should(Equal("user.list"))
+			Expect(actionHandlers[0].pattern()).Should(Equal("/admin/users"))
+			Expect(actionHandlers[0].alias).Should(Equal("GET users"))
+
+			Expect(actionHandlers[1].action).Should(Equal("auth.login"))
+			Expect(actionHandlers[1].pattern()).Should(Equal("/admin/login"))
+			Expect(actionHandlers[1].alias).Should(Equal("login"))
+		})
+
+		It("should create action handler with route path and action name", func() {
+			route := map[string]interface{}{
+				"path": "/api",
+			}
+
+			actionHandlers := createActionHandlers(route, []string{"user.list", "auth.login"}, log.WithField("unit", "test"))
+			Expect(len(actionHandlers)).Should(Equal(2))
+
+			Expect(actionHandlers[0].action).Should(Equal("user.list"))
+			Expect(actionHandlers[0].pattern()).Should(Equal("/api/user/list"))
+
+			Expect(actionHandlers[1].action).Should(Equal("auth.login"))
+			Expect(actionHandlers[1].pattern()).Should(Equal("/api/auth/login"))
+
+			route = map[string]interface{}{
+				"path": "/somePrefix/",
+			}
+			actionHandlers = createActionHandlers(route, []string{"profile.create", "image.upload", "msg.send"}, log.WithField("unit", "test"))
+			Expect(len(actionHandlers)).Should(Equal(3))
+
+			Expect(actionHandlers[0].action).Should(Equal("profile.create"))
+			Expect(actionHandlers[0].pattern()).Should(Equal("/somePrefix/profile/create"))
+			Expect(actionHandlers[0].action).Should(Equal("profile.create"))
+		})
+
+		It("should expand the REST shorthand alias into the CRUD aliases", func() {
+			route := map[string]interface{}{
+				"path":          "/api",
+				"mappingPolicy": "restrict",
+				"aliases": map[string]string{
+					"REST users": "users",
+				},
+			}
+
+			actionHandlers := createActionHandlers(route, []string{"users.list", "users.get", "users.create", "users.update", "users.remove", "users.ban"}, log.WithField("unit", "test"))
+			Expect(len(actionHandlers)).Should(Equal(5))
+
+			routes := map[string]string{}
+			for _, handler := range actionHandlers {
+				for method := range handler.acceptedMethods() {
+					routes[method+" "+handler.pattern()] = handler.action
+				}
+			}
+			Expect(routes).Should(Equal(map[string]string{
+				"GET /api/users":         "users.list",
+				"GET /api/users/{id}":    "users.get",
+				"POST /api/users":        "users.create",
+				"PUT /api/users/{id}":    "users.update",
+				"DELETE /api/users/{id}": "users.remove",
+			}))
+		})
+
+		It("should expand wildcard aliases for every matching action", func() {
+			route := map[string]interface{}{
+				"path":          "/api",
+				"mappingPolicy": "restrict",
+				"aliases": map[string]string{
+					"users/{action}":   "users.*",
+					"GET auth/:action": "auth.*",
+					"login":            "auth.login",
+				},
+			}
+
+			actionHandlers := createActionHandlers(route, []string{"users.list", "users.get", "auth.login", "auth.logout", "orders.list"}, log.WithField("unit", "test"))
+			Expect(len(actionHandlers)).Should(Equal(4))
+
+			Expect(actionHandlers[0].action).Should(Equal("users.list"))
+			Expect(actionHandlers[0].pattern()).Should(Equal("/api/users/list"))
+
+			Expect(actionHandlers[1].action).Should(Equal("users.get"))
+			Expect(actionHandlers[1].pattern()).Should(Equal("/api/users/get"))
+
+			Expect(actionHandlers[2].action).Should(Equal("auth.login"))
+			Expect(actionHandlers[2].pattern()).Should(Equal("/api/login"))
+
+			Expect(actionHandlers[3].action).Should(Equal("auth.logout"))
+			Expect(actionHandlers[3].pattern()).Should(Equal("/api/auth/logout"))
+			Expect(actionHandlers[3].acceptedMethods()).Should(Equal(map[string]bool{"GET": true}))
+		})
+
+		It("should log and skip malformed aliases instead of panicking", func() {
+			logger, hook := logtest.NewNullLogger()
+			route := map[string]interface{}{
+				"path":          "/api",
+				"mappingPolicy": "restrict",
+				"aliases": map[string]string{
+					"GET users list extra": "users.list",
+					"FETCH users/:id":      "users.get",
+					"POST users abc":       "users.create",
+					"DELETE users/:id 204": "users.remove",
+				},
+			}
+			var actionHandlers []*actionHandler
+			Expect(func() {
+				actionHandlers = createActionHandlers(route, []string{"users.list", "users.get", "users.create", "users.remove"}, log.NewEntry(logger))
+			}).ShouldNot(Panic())
+			Expect(actionHandlers).Should(HaveLen(1))
+			Expect(actionHandlers[0].action).Should(Equal("users.remove"))
+			Expect(actionHandlers[0].pattern()).Should(Equal("/api/users/{id}"))
+
+			Expect(hook.AllEntries()).Should(HaveLen(3))
+			for _, entry := range hook.AllEntries() {
+				Expect(entry.Level).Should(Equal(log.WarnLevel))
+				Expect(entry.Message).Should(ContainSubstring("skipping alias"))
+			}
+		})
+
+		It("should log a warning for the aliases mapped to unknown actions", func() {
+			logger, hook := logtest.NewNullLogger()
+			route := map[string]interface{}{
+				"path": "/api",
+				"aliases": map[string]string{
+					"GET users":        "users.lst",
+					"GET users/:id":    "users.get",
+					"GET profiles/:id": "profiles.*",
+				},
+			}
+			createActionHandlers(route, []string{"users.list", "users.get", "profiles.get"}, log.NewEntry(logger))
+			Expect(hook.AllEntries()).Should(HaveLen(1))
+			Expect(hook.LastEntry().Level).Should(Equal(log.WarnLevel))
+			Expect(hook.LastEntry().Message).Should(Equal("Gateway alias: GET users maps to unknown action: users.lst"))
+		})
+
+		It("should validate the alias format", func() {
+			Expect(validateAlias("users")).Should(Succeed())
+			Expect(validateAlias("GET|POST users")).Should(Succeed())
+			Expect(validateAlias("SSE notifications")).Should(Succeed())
+			Expect(validateAlias("POST users 201")).Should(Succeed())
+			Expect(validateAlias("GET users list extra")).Should(MatchError(ContainSubstring("Invalid alias format")))
+			Expect(validateAlias("FETCH users")).Should(MatchError(ContainSubstring("Invalid alias method")))
+			Expect(validateAlias("POST users 500")).Should(MatchError(ContainSubstring("Invalid alias success code")))
+		})
+	})
+
+	Describe("authorization", func() {
+		route := map[string]interface{}{"path": "/", "authorization": true}
+		settings := map[string]interface{}{
+			"authorize": func(ctx moleculer.Context, route map[string]interface{}, req *http.Request) (moleculer.Payload, error) {
+				if req.Header.Get("Authorization") != "secret" {
+					return nil, errors.New("Invalid credentials")
+				}
+				return payload.Empty().Add("name", "John"), nil
+			},
+		}
+
+		It("should call the action when authorize allows the request", func() {
+			var meta moleculer.Payload
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				meta = ctx.Meta()
+				return "allowed"
+			})
+			handler := actionHandler{action: "users.list", route: route, settings: settings, context: ctx}
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+			request.Header.Set("Authorization", "secret")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(response.Body.String()).Should(Equal("allowed"))
+			Expect(meta.Get("user").Get("name").String()).Should(Equal("John"))
+		})
+
+		It("should respond 401 without calling the action when authorize denies the request", func() {
+			ctx, calls := mockActionContext("allowed")
+			handler := actionHandler{action: "users.list", route: route, settings: settings, context: ctx}
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+			request.Header.Set("Authorization", "wrong")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(*calls).Should(Equal(0))
+			Expect(response.Code).Should(Equal(http.StatusUnauthorized))
+			Expect(gjson.Get(response.Body.String(), "error").String()).Should(Equal("Invalid credentials"))
+		})
+
+		It("should respond 401 when authorization is on and no authorize function is configured", func() {
+			ctx, calls := mockActionContext("allowed")
+			handler := actionHandler{action: "users.list", route: route, settings: map[string]interface{}{}, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			Expect(*calls).Should(Equal(0))
+			Expect(response.Code).Should(Equal(http.StatusUnauthorized))
+		})
+
+		It("should not invoke authorize when the route has authorization off", func() {
+			ctx, calls := mockActionContext("open")
+			handler := actionHandler{action: "users.list", route: map[string]interface{}{"path": "/"}, settings: settings, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			Expect(*calls).Should(Equal(1))
+			Expect(response.Body.String()).Should(Equal("open"))
+		})
+	})
+
+	Describe("onBeforeCall", func() {
+		It("should use the params returned by the hook in the action call", func() {
+			settings := map[string]interface{}{
+				"onBeforeCall": func(ctx moleculer.Context, req *http.Request, params moleculer.Payload) moleculer.Payload {
+					return params.Add("token", req.Header.Get("Authorization"))
+				},
+			}
+			handler := actionHandler{alias: "GET users/list", action: "users.list", settings: settings, context: echoActionContext()}
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/list?name=John", nil)
+			request.Header.Set("Authorization", "Bearer 123")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			json := response.Body.String()
+			Expect(gjson.Get(json, "token").String()).Should(Equal("Bearer 123"))
+			Expect(gjson.Get(json, "name").String()).Should(Equal("John"))
+		})
+
+		It("should keep the params unchanged when no hook is configured", func() {
+			handler := actionHandler{action: "users.list", settings: map[string]interface{}{}, context: echoActionContext()}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list?name=John", nil))
+			json := response.Body.String()
+			Expect(gjson.Get(json, "name").String()).Should(Equal("John"))
+			Expect(gjson.Get(json, "token").Exists()).Should(BeFalse())
+		})
+	})
+
+	Describe("onAfterCall", func() {
+		settings := map[string]interface{}{
+			"onAfterCall": func(ctx moleculer.Context, resp http.ResponseWriter, result moleculer.Payload) moleculer.Payload {
+				if result.IsError() {
+					return payload.New(codeError{"wrapped: " + result.Error().Error(), 400})
+				}
+				return result.Add("envelope", true)
+			},
+		}
+
+		It("should send the result returned by the hook", func() {
+			ctx, _ := mockActionContext(map[string]interface{}{"name": "John"})
+			handler := actionHandler{action: "users.get", settings: settings, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/get", nil))
+			json := response.Body.String()
+			Expect(gjson.Get(json, "name").String()).Should(Equal("John"))
+			Expect(gjson.Get(json, "envelope").Bool()).Should(BeTrue())
+		})
+
+		It("should also run for error results", func() {
+			ctx, _ := mockActionContext(errors.New("boom"))
+			handler := actionHandler{action: "users.get", settings: settings, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/get", nil))
+			Expect(response.Code).Should(Equal(400))
+			Expect(gjson.Get(response.Body.String(), "error").String()).Should(Equal("wrapped: boom"))
+		})
+	})
+
+	Describe("onError", func() {
+		It("should let the onError handler write the error response", func() {
+			settings := map[string]interface{}{
+				"onError": func(ctx moleculer.Context, resp http.ResponseWriter, err moleculer.Payload) {
+					resp.WriteHeader(http.StatusTeapot)
+					resp.Write([]byte("custom: " + err.Error().Error()))
+				},
+			}
+			ctx, _ := mockActionContext(errors.New("boom"))
+			handler := actionHandler{action: "users.get", settings: settings, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/get", nil))
+			Expect(response.Code).Should(Equal(http.StatusTeapot))
+			Expect(response.Body.String()).Should(Equal("custom: boom"))
+		})
+
+		It("should not invoke the onError handler for successful results", func() {
+			onErrorCalled := false
+			settings := map[string]interface{}{
+				"onError": func(ctx moleculer.Context, resp http.ResponseWriter, err moleculer.Payload) {
+					onErrorCalled = true
+				},
+			}
+			ctx, _ := mockActionContext("fine")
+			handler := actionHandler{action: "users.get", settings: settings, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/get", nil))
+			Expect(onErrorCalled).Should(BeFalse())
+			Expect(response.Body.String()).Should(Equal("fine"))
+		})
+
+		It("should fallback to the default error response when no handler is configured", func() {
+			ctx, _ := mockActionContext(errors.New("boom"))
+			handler := actionHandler{action: "users.get", settings: map[string]interface{}{}, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/get", nil))
+			Expect(response.Code).Should(Equal(errorStatusCode))
+			Expect(gjson.Get(response.Body.String(), "error").String()).Should(Equal("boom"))
+		})
+	})
+
+	Describe("callTimeout", func() {
+		settings := map[string]interface{}{"callTimeout": 50 * time.Millisecond}
+
+		It("should send the result of an action that responds in time", func() {
+			ctx, _ := mockActionContext("fast")
+			handler := actionHandler{action: "users.get", settings: settings, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/get", nil))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(response.Body.String()).Should(Equal("fast"))
+		})
+
+		It("should respond 504 when the action does not respond in time", func() {
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				time.Sleep(200 * time.Millisecond)
+				return "slow"
+			})
+			handler := actionHandler{action: "users.get", settings: settings, context: ctx}
+			response := httptest.NewRecorder()
+			start := time.Now()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/get", nil))
+			Expect(time.Since(start)).Should(BeNumerically("<", 200*time.Millisecond))
+			Expect(response.Code).Should(Equal(http.StatusGatewayTimeout))
+			Expect(gjson.Get(response.Body.String(), "error").String()).Should(ContainSubstring("Gateway Timeout"))
+		})
+
+		It("should stop waiting and respond 499 when the client disconnects", func() {
+			release := make(chan bool)
+			defer close(release)
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				<-release
+				return "late"
+			})
+			handler := actionHandler{action: "users.get", context: ctx}
+			requestContext, cancel := stdcontext.WithCancel(stdcontext.Background())
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/get", nil).WithContext(requestContext)
+			response := httptest.NewRecorder()
+			time.AfterFunc(20*time.Millisecond, cancel)
+			start := time.Now()
+			handler.ServeHTTP(response, request)
+			Expect(time.Since(start)).Should(BeNumerically("<", time.Second))
+			Expect(response.Code).Should(Equal(clientClosedStatusCode))
+			Expect(response.Body.String()).Should(BeEmpty())
+		})
+	})
+
+	Describe("allowMethodOverride", func() {
+		ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+			return ctx.ActionName()
+		})
+		serve := func(settings map[string]interface{}, method, override string) *httptest.ResponseRecorder {
+			handler := actionHandler{alias: "DELETE users/:id", action: "users.remove", settings: settings, context: ctx}
+			request := httptest.NewRequest(method, "http://local/users/1", nil)
+			request.Header.Set("X-HTTP-Method-Override", override)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			return response
+		}
+
+		It("should handle a POST with the override header as DELETE", func() {
+			response := serve(map[string]interface{}{"allowMethodOverride": true}, http.MethodPost, "delete")
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(response.Body.String()).Should(Equal("users.remove"))
+		})
+
+		It("should ignore the override header when allowMethodOverride is off", func() {
+			response := serve(map[string]interface{}{}, http.MethodPost, "DELETE")
+			Expect(response.Code).Should(Equal(http.StatusMethodNotAllowed))
+		})
+
+		It("should only override POST requests to valid methods", func() {
+			settings := map[string]interface{}{"allowMethodOverride": true}
+			Expect(serve(settings, http.MethodGet, "DELETE").Code).Should(Equal(http.StatusMethodNotAllowed))
+			Expect(serve(settings, http.MethodPost, "TRACE").Code).Should(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+
+	Describe("route cache", func() {
+		route := map[string]interface{}{"path": "/", "cache": map[string]interface{}{"ttl": 100 * time.Millisecond, "maxEntries": 2}}
+		newHandler := func(result interface{}) (*actionHandler, *int) {
+			ctx, calls := mockActionContext(result)
+			handlers := createActionHandlers(route, []string{"users.list"}, log.WithField("unit", "test"))
+			handlers[0].context = ctx
+			return handlers[0], calls
+		}
+		get := func(handler *actionHandler, target string) *httptest.ResponseRecorder {
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, target, nil))
+			return response
+		}
+
+		It("should serve the second identical GET from the cache until the ttl expires", func() {
+			handler, calls := newHandler(map[string]interface{}{"name": "John"})
+			first := get(handler, "http://local/users/list?page=1")
+			Expect(first.Body.String()).Should(Equal(`{"name":"John"}`))
+			Expect(first.Header().Get("Age")).Should(BeEmpty())
+
+			second := get(handler, "http://local/users/list?page=1")
+			Expect(*calls).Should(Equal(1))
+			Expect(second.Code).Should(Equal(http.StatusOK))
+			Expect(second.Body.String()).Should(Equal(`{"name":"John"}`))
+			Expect(second.Header().Get("Age")).Should(Equal("0"))
+			Expect(second.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Expect(second.Header().Get("ETag")).Should(Equal(first.Header().Get("ETag")))
+			Expect(second.Header().Get("X-Request-ID")).ShouldNot(Equal(first.Header().Get("X-Request-ID")))
+
+			get(handler, "http://local/users/list?page=2")
+			Expect(*calls).Should(Equal(2))
+
+			time.Sleep(150 * time.Millisecond)
+			expired := get(handler, "http://local/users/list?page=1")
+			Expect(*calls).Should(Equal(3))
+			Expect(expired.Header().Get("Age")).Should(BeEmpty())
+		})
+
+		It("should drop the least recently used responses over maxEntries", func() {
+			handler, calls := newHandler("result")
+			get(handler, "http://local/users/list?page=1")
+			get(handler, "http://local/users/list?page=2")
+			get(handler, "http://local/users/list?page=1")
+			get(handler, "http://local/users/list?page=3")
+			Expect(*calls).Should(Equal(3))
+			get(handler, "http://local/users/list?page=1")
+			Expect(*calls).Should(Equal(3))
+			get(handler, "http://local/users/list?page=2")
+			Expect(*calls).Should(Equal(4))
+		})
+
+		It("should not cache errors or other methods", func() {
+			handler, calls := newHandler(errors.New("failed"))
+			get(handler, "http://local/users/list")
+			Expect(get(handler, "http://local/users/list").Code).Should(Equal(errorStatusCode))
+			Expect(*calls).Should(Equal(2))
+
+			handler, calls = newHandler("result")
+			for i := 0; i < 2; i++ {
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://local/users/list", nil))
+			}
+			Expect(*calls).Should(Equal(2))
+		})
+
+		It("should not cache the authenticated requests", func() {
+			ctx, calls := mockActionContext("result")
+			authorizedRoute := map[string]interface{}{"path": "/", "authorization": true, "cache": route["cache"]}
+			handlers := createActionHandlers(authorizedRoute, []string{"users.list"}, log.WithField("unit", "test"))
+			handler := handlers[0]
+			handler.context = ctx
+			handler.settings = map[string]interface{}{
+				"authorize": func(ctx moleculer.Context, route map[string]interface{}, request *http.Request) (moleculer.Payload, error) {
+					if request.Header.Get("Authorization") != "Bearer alice" {
+						return nil, errors.New("invalid token")
+					}
+					return payload.New(map[string]interface{}{"name": "alice"}), nil
+				},
+			}
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+			request.Header.Set("Authorization", "Bearer alice")
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			Expect(*calls).Should(Equal(1))
+			Expect(get(handler, "http://local/users/list").Code).Should(Equal(http.StatusUnauthorized))
+			Expect(*calls).Should(Equal(1))
+
+			handler, calls = newHandler("result")
+			for i := 0; i < 2; i++ {
+				request := withUser(httptest.NewRequest(http.MethodGet, "http://local/users/list", nil), payload.Empty().Add("name", "bob"))
+				handler.ServeHTTP(httptest.NewRecorder(), request)
+			}
+			Expect(*calls).Should(Equal(2))
+		})
+
+		It("should keep a response per value of the passHeaders", func() {
+			var calls int32
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				atomic.AddInt32(&calls, 1)
+				return "tenant " + ctx.Meta().Get("headers").Get("X-Tenant").String()
+			})
+			tenantRoute := map[string]interface{}{"path": "/", "passHeaders": []string{"X-Tenant"}, "cache": route["cache"]}
+			handler := createActionHandlers(tenantRoute, []string{"users.list"}, log.WithField("unit", "test"))[0]
+			handler.context = ctx
+			getAs := func(tenant string) string {
+				request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+				request.Header.Set("X-Tenant", tenant)
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, request)
+				return response.Body.String()
+			}
+			Expect(getAs("acme")).Should(Equal("tenant acme"))
+			Expect(getAs("globex")).Should(Equal("tenant globex"))
+			Expect(getAs("acme")).Should(Equal("tenant acme"))
+			Expect(atomic.LoadInt32(&calls)).Should(Equal(int32(2)))
+		})
+
+		It("should not cache requests with credentials or params built from the request", func() {
+			handler, calls := newHandler("result")
+			for _, header := range []string{"Authorization", "Cookie"} {
+				for i := 0; i < 2; i++ {
+					request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+					request.Header.Set(header, "secret")
+					handler.ServeHTTP(httptest.NewRecorder(), request)
+				}
+			}
+			Expect(*calls).Should(Equal(4))
+
+			handler, calls = newHandler("result")
+			handler.settings = map[string]interface{}{
+				"onBeforeCall": func(ctx moleculer.Context, request *http.Request, params moleculer.Payload) moleculer.Payload {
+					return params.Add("tenant", request.Header.Get("X-Tenant"))
+				},
+			}
+			get(handler, "http://local/users/list")
+			get(handler, "http://local/users/list")
+			Expect(*calls).Should(Equal(2))
+
+			ctx, calls := mockActionContext("result")
+			mapperRoute := map[string]interface{}{"path": "/", "cache": route["cache"], "paramMapper": func(request *http.Request) moleculer.Payload {
+				return payload.Empty().Add("tenant", request.Header.Get("X-Tenant"))
+			}}
+			handler = createActionHandlers(mapperRoute, []string{"users.list"}, log.WithField("unit", "test"))[0]
+			handler.context = ctx
+			get(handler, "http://local/users/list")
+			get(handler, "http://local/users/list")
+			Expect(*calls).Should(Equal(2))
+		})
+
+		It("should not store the headers set by the middlewares", func() {
+			handler, calls := newHandler(strings.Repeat("result", 100))
+			cors := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				response.Header().Set("Access-Control-Allow-Origin", request.Header.Get("Origin"))
+				handler.ServeHTTP(response, request)
+			})
+			server := compressionMiddleware(map[string]interface{}{"compression": map[string]interface{}{"threshold": 100}}, cors)
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+			request.Header.Set("Accept-Encoding", "gzip")
+			request.Header.Set("Origin", "http://first.com")
+			first := httptest.NewRecorder()
+			server.ServeHTTP(first, request)
+			Expect(first.Header().Get("Content-Encoding")).Should(Equal("gzip"))
+
+			request = httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+			request.Header.Set("Origin", "http://second.com")
+			second := httptest.NewRecorder()
+			server.ServeHTTP(second, request)
+			Expect(*calls).Should(Equal(1))
+			Expect(second.Header().Get("Age")).Should(Equal("0"))
+			Expect(second.Header().Get("Content-Encoding")).Should(BeEmpty())
+			Expect(second.Header().Get("Access-Control-Allow-Origin")).Should(Equal("http://second.com"))
+			Expect(second.Body.String()).Should(Equal(strings.Repeat("result", 100)))
+		})
+
+		It("should not create a cache for routes without the cache setting", func() {
+			handlers := createActionHandlers(map[string]interface{}{"path": "/"}, []string{"users.list"}, log.WithField("unit", "test"))
+			Expect(handlers[0].cache).Should(BeNil())
+		})
+	})
+
+	Describe("maxConcurrent", func() {
+		It("should respond 503 while the maxConcurrent calls are in flight", func() {
+			var calls int32
+			release := make(chan bool)
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "done"
+			})
+			handler := actionHandler{action: "users.get", context: ctx, callSlots: make(chan bool, 2)}
+			handler.acceptedMethodsCache = handler.allowedAliasMethods()
+			responses := make(chan *httptest.ResponseRecorder, 2)
+			for i := 0; i < 2; i++ {
+				go func() {
+					response := httptest.NewRecorder()
+					handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/get", nil))
+					responses <- response
+				}()
+			}
+			Eventually(func() int { return len(handler.callSlots) }).Should(Equal(2))
+
+			for i := 0; i < 3; i++ {
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/get", nil))
+				Expect(response.Code).Should(Equal(http.StatusServiceUnavailable))
+				Expect(response.Header().Get("Retry-After")).Should(Equal("1"))
+			}
+			Expect(atomic.LoadInt32(&calls)).Should(Equal(int32(2)))
+
+			close(release)
+			for i := 0; i < 2; i++ {
+				Expect((<-responses).Body.String()).Should(Equal("done"))
+			}
+			Expect(handler.callSlots).Should(BeEmpty())
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/get", nil))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+		})
+	})
+
+	Describe("callOptions", func() {
+		flakyContext := func(failures int) (moleculer.Context, *int) {
+			calls := 0
+			return actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				calls++
+				if calls <= failures {
+					return errors.New("flaky failure")
+				}
+				return "done"
+			}), &calls
+		}
+
+		It("should retry a flaky action up to the configured retries", func() {
+			ctx, calls := flakyContext(2)
+			route := map[string]interface{}{"callOptions": map[string]interface{}{"retries": 2}}
+			handler := actionHandler{action: "users.flaky", route: route, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/flaky", nil))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(response.Body.String()).Should(Equal("done"))
+			Expect(*calls).Should(Equal(3))
+		})
+
+		It("should send the error when the retries are exhausted", func() {
+			ctx, calls := flakyContext(5)
+			route := map[string]interface{}{"callOptions": map[string]interface{}{"retries": 1}}
+			handler := actionHandler{action: "users.flaky", route: route, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/flaky", nil))
+			Expect(response.Code).Should(Equal(errorStatusCode))
+			Expect(*calls).Should(Equal(2))
+		})
+
+		It("should send the fallbackResponse when the action keeps failing", func() {
+			ctx, _ := flakyContext(5)
+			route := map[string]interface{}{"callOptions": map[string]interface{}{
+				"fallbackResponse": func(ctx moleculer.Context, result moleculer.Payload) interface{} {
+					return "fallback: " + result.Error().Error()
+				},
+			}}
+			handler := actionHandler{action: "users.flaky", route: route, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/flaky", nil))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(response.Body.String()).Should(Equal("fallback: flaky failure"))
+		})
+
+		It("should not change the configured fallbackResponse between requests", func() {
+			ctx, _ := flakyContext(10)
+			fallback := map[string]interface{}{"items": []interface{}{}, "page": map[string]interface{}{"total": 0}}
+			route := map[string]interface{}{"callOptions": map[string]interface{}{"fallbackResponse": fallback}}
+			calls := 0
+			settings := map[string]interface{}{
+				"onAfterCall": func(ctx moleculer.Context, response http.ResponseWriter, result moleculer.Payload) moleculer.Payload {
+					calls++
+					result.Get("page").RawMap()["request"] = calls
+					return result.Add("stale", true)
+				},
+			}
+			handler := actionHandler{action: "users.flaky", route: route, settings: settings, context: ctx}
+			for request := 1; request <= 2; request++ {
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/flaky", nil))
+				Expect(response.Code).Should(Equal(succesStatusCode))
+				json := response.Body.String()
+				Expect(gjson.Get(json, "stale").Bool()).Should(BeTrue())
+				Expect(gjson.Get(json, "page.request").Int()).Should(Equal(int64(request)))
+			}
+			Expect(fallback).Should(Equal(map[string]interface{}{"items": []interface{}{}, "page": map[string]interface{}{"total": 0}}))
+		})
+	})
+
+	Describe("success status code", func() {
+		It("should use the status from the alias", func() {
+			ctx, _ := mockActionContext(map[string]interface{}{"id": 1})
+			handler := actionHandler{alias: "POST users 201", action: "users.create", context: ctx}
+			Expect(handler.pattern()).Should(Equal("/users"))
+			Expect(handler.acceptedMethods()).Should(BeEquivalentTo(map[string]bool{"POST": true}))
+
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "http://local/users", nil))
+			Expect(response.Code).Should(Equal(http.StatusCreated))
+		})
+
+		It("should use the route successCode setting", func() {
+			ctx, _ := mockActionContext("accepted")
+			handler := actionHandler{alias: "POST jobs", action: "jobs.create", route: map[string]interface{}{"successCode": 202}, context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "http://local/jobs", nil))
+			Expect(response.Code).Should(Equal(http.StatusAccepted))
+		})
+
+		It("should keep the error status for errors", func() {
+			ctx, _ := mockActionContext(errors.New("boom"))
+			handler := actionHandler{alias: "POST users 201", action: "users.create", context: ctx}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "http://local/users", nil))
+			Expect(response.Code).Should(Equal(errorStatusCode))
+		})
+	})
+
+	Describe("route name", func() {
+		It("should stamp handlers with the owning route and expose it to hooks", func() {
+			var routeNames []string
+			settings := map[string]interface{}{
+				"onBeforeCall": func(ctx moleculer.Context, req *http.Request, params moleculer.Payload) moleculer.Payload {
+					routeNames = append(routeNames, RouteName(req))
+					return params
+				},
+			}
+			publicHandlers := createActionHandlers(map[string]interface{}{"name": "public", "path": "/public"}, []string{"user.list"}, log.WithField("unit", "test"))
+			adminHandlers := createActionHandlers(map[string]interface{}{"path": "/admin"}, []string{"user.list"}, log.WithField("unit", "test"))
+			Expect(publicHandlers[0].routeName).Should(Equal("public"))
+			Expect(adminHandlers[0].routeName).Should(Equal("/admin"))
+
+			router := mux.NewRouter()
+			for _, handler := range append(publicHandlers, adminHandlers...) {
+				handler.context, _ = mockActionContext("listed")
+				handler.settings = settings
+				router.Handle(handler.pattern(), handler)
+			}
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://local/public/user/list", nil))
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://local/admin/user/list", nil))
+			Expect(routeNames).Should(Equal([]string{"public", "/admin"}))
+		})
+	})
+
+	Describe("path params", func() {
+
+		It("should translate :param segments into mux variables", func() {
+			handler := actionHandler{routePath: "/", alias: "GET users/:id", action: "users.get"}
+			Expect(handler.pattern()).Should(Equal("/users/{id}"))
+
+			handler = actionHandler{routePath: "/api", alias: "GET users/:userId/posts/:postId", action: "posts.get"}
+			Expect(handler.pattern()).Should(Equal("/api/users/{userId}/posts/{postId}"))
+
+			handler = actionHandler{routePath: "/", alias: "GET users/list", action: "users.list"}
+			Expect(handler.pattern()).Should(Equal("/users/list"))
+		})
+
+		It("should translate regex constrained params into mux constraints", func() {
+			handler := actionHandler{routePath: "/", alias: `GET users/:id(\d+)`, action: "users.get"}
+			Expect(handler.pattern()).Should(Equal(`/users/{id:\d+}`))
+
+			handler = actionHandler{routePath: "/", alias: "GET posts/:slug([a-z-]+)/comments/:page([0-9]+)", action: "comments.list"}
+			Expect(handler.pattern()).Should(Equal("/posts/{slug:[a-z-]+}/comments/{page:[0-9]+}"))
+		})
+
+		It("should call the action only when the param matches the regex", func() {
+			handler := &actionHandler{routePath: "/", alias: `GET users/:id(\d+)`, action: "users.get", context: echoActionContext()}
+			router := mux.NewRouter()
+			router.Handle(handler.pattern(), handler)
+
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/123", nil))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(gjson.Get(response.Body.String(), "id").String()).Should(Equal("123"))
+
+			response = httptest.NewRecorder()
+			router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/john", nil))
+			Expect(response.Code).Should(Equal(http.StatusNotFound))
+		})
+
+		It("should merge a single path param into the action params", func() {
+			handler := &actionHandler{routePath: "/", alias: "GET users/:id", action: "users.get", context: echoActionContext()}
+			router := mux.NewRouter()
+			router.Handle(handler.pattern(), handler)
+
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/123", nil))
+			Expect(response.Code).Should(Equal(succesStatusCode))
+			Expect(gjson.Get(response.Body.String(), "id").String()).Should(Equal("123"))
+		})
+
+		It("should merge multiple path params with body params", func() {
+			handler := &actionHandler{routePath: "/", alias: "PUT users/:userId/posts/:postId", action: "posts.update", context: echoActionContext()}
+			router := mux.NewRouter()
+			router.Handle(handler.pattern(), handler)
+
+			response := httptest.NewRecorder()
+			body := strings.NewReader(`{"title":"Hello"}`)
+			router.ServeHTTP(response, httptest.NewRequest(http.MethodPut, "http://local/users/7/posts/42", body))
+			json := response.Body.String()
+			Expect(gjson.Get(json, "userId").String()).Should(Equal("7"))
+			Expect(gjson.Get(json, "postId").String()).Should(Equal("42"))
+			Expect(gjson.Get(json, "title").String()).Should(Equal("Hello"))
+		})
+
+		It("should resolve the same param with the route paramPrecedence", func() {
+			call := func(route map[string]interface{}) string {
+				handler := &actionHandler{routePath: "/", alias: "PUT users/:id", action: "users.update", route: route, context: echoActionContext()}
+				router := mux.NewRouter()
+				router.Handle(handler.pattern(), handler)
+				response := httptest.NewRecorder()
+				body := strings.NewReader(`{"id":"body"}`)
+				router.ServeHTTP(response, httptest.NewRequest(http.MethodPut, "http://local/users/path?id=query", body))
+				return gjson.Get(response.Body.String(), "id").String()
+			}
+			Expect(call(map[string]interface{}{})).Should(Equal("path"))
+			Expect(call(map[string]interface{}{"paramPrecedence": []string{"query", "body", "path"}})).Should(Equal("query"))
+			Expect(call(map[string]interface{}{"paramPrecedence": []string{"body"}})).Should(Equal("body"))
+		})
+
+		It("should use the route paramMapper instead of the request params", func() {
+			route := map[string]interface{}{"paramMapper": func(request *http.Request) moleculer.Payload {
+				return payload.Empty().Add("tenant", request.Header.Get("X-Tenant"))
+			}}
+			handler := &actionHandler{action: "users.list", route: route, context: echoActionContext()}
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/list?name=John", nil)
+			request.Header.Set("X-Tenant", "acme")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(gjson.Get(response.Body.String(), "tenant").String()).Should(Equal("acme"))
+			Expect(gjson.Get(response.Body.String(), "name").Exists()).Should(BeFalse())
+		})
+
+		It("should send the route alwaysArray params as arrays with one or more values", func() {
+			route := map[string]interface{}{"alwaysArray": []string{"tags"}}
+			call := func(method, target string, body io.Reader) string {
+				handler := &actionHandler{action: "users.list", route: route, context: echoActionContext()}
+				request := httptest.NewRequest(method, target, body)
+				if body != nil {
+					request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				}
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, request)
+				return response.Body.String()
+			}
+			Expect(call(http.MethodGet, "http://local/users/list?tags=stark&name=John", nil)).Should(Equal(`{"name":"John","tags":["stark"]}`))
+			Expect(call(http.MethodGet, "http://local/users/list?tags=stark&tags=snow", nil)).Should(Equal(`{"tags":["stark","snow"]}`))
+			Expect(call(http.MethodPost, "http://local/users/list", strings.NewReader("tags=stark&name=John"))).Should(Equal(`{"name":"John","tags":["stark"]}`))
+			Expect(call(http.MethodPost, "http://local/users/list", strings.NewReader("tags=stark&tags=snow"))).Should(Equal(`{"tags":["stark","snow"]}`))
+		})
+
+		It("should complete the paramPrecedence with the missing sources", func() {
+			Expect(paramPrecedence(nil, nil)).Should(Equal([]string{"path", "body", "query"}))
+			Expect(paramPrecedence(nil, map[string]interface{}{"paramPrecedence": []string{"query"}})).Should(Equal([]string{"query", "path", "body"}))
+			route := map[string]interface{}{"paramPrecedence": []string{"body", "query"}}
+			Expect(paramPrecedence(route, map[string]interface{}{"paramPrecedence": []string{"query"}})).Should(Equal([]string{"body", "query", "path"}))
+		})
+	})
+
+	Describe("shouldInclude", func() {
+		var actions = []string{
+			"user.list",
+			"user.get",
+			"user.create",
+			"user.remove",
+			"user.update",
+
+			"profile.list",
+			"profile.get",
+			"profile.create",
+			"profile.remove",
+			"profile.update",
+
+			"auth.login",
+			"auth.logout",
+
+			"math.add",
+			"math.subtract",
+		}
+		It("must return true for **", func() {
+			for _, action := range actions {
+				Expect(shouldInclude(compilePatterns([]string{"**"}), action)).Should(BeTrue())
+				Expect(shouldInclude(compilePatterns([]string{"*.*"}), action)).Should(BeTrue())
+			}
+		})
+
+		It("must handle action wildcards service.*", func() {
+			Expect(shouldInclude(compilePatterns([]string{"user.*"}), "user.list")).Should(BeTrue())
+			Expect(shouldInclude(compilePatterns([]string{"profile.*"}), "user.list")).Should(BeFalse())
+
+			Expect(shouldInclude(compilePatterns([]string{"user.*"}), "profile.list")).Should(BeFalse())
+			Expect(shouldInclude(compilePatterns([]string{"profile.*"}), "profile.list")).Should(BeTrue())
+		})
+
+		It("must handle action wildcards *.list", func() {
+			Expect(shouldInclude(compilePatterns([]string{"*.list"}), "user.list")).Should(BeTrue())
+			Expect(shouldInclude(compilePatterns([]string{"*.list"}), "profile.list")).Should(BeTrue())
+			Expect(shouldInclude(compilePatterns([]string{"*.create"}), "user.list")).Should(BeFalse())
+
+			Expect(shouldInclude(compilePatterns([]string{"*.create"}), "user.create")).Should(BeTrue())
+			Expect(shouldInclude(compilePatterns([]string{"*.create"}), "profile.create")).Should(BeTrue())
+			Expect(shouldInclude(compilePatterns([]string{"*.create"}), "auth.login")).Should(BeFalse())
+		})
+
+		It("must match the same actions with the patterns compiled once", func() {
+			patterns := compilePatterns([]string{"user.*", "*.login", "/math\\.\\w+/"})
+			included := []string{}
+			for _, action := range actions {
+				if shouldInclude(patterns, action) {
+					included = append(included, action)
+				}
+			}
+			Expect(included).Should(Equal([]string{
+				"user.list", "user.get", "user.create", "user.remove", "user.update",
+				"auth.login", "math.add", "math.subtract",
+			}))
+			Expect(shouldInclude(compilePatterns([]string{}), "user.list")).Should(BeFalse())
+			Expect(shouldInclude(compilePatterns([]string{"/(/"}), "user.list")).Should(BeFalse())
+		})
+
+		It("must handle regular expressions between slashes", func() {
+			Expect(shouldInclude(compilePatterns([]string{"/.*\\.list/"}), "user.list")).Should(BeTrue())
+			Expect(shouldInclude(compilePatterns([]string{"/.*\\.list/"}), "profile.list")).Should(BeTrue())
+			Expect(shouldInclude(compilePatterns([]string{"/.*\\.list/"}), "v1.auth.list")).Should(BeTrue())
+			Expect(shouldInclude(compilePatterns([]string{"/^math\\.\\w+$/"}), "math.add")).Should(BeTrue())
+		})
+
+		It("must anchor regular expressions to the whole action name", func() {
+			Expect(shouldInclude(compilePatterns([]string{"/user\\.get/"}), "user.get")).Should(BeTrue())
+			Expect(shouldInclude(compilePatterns([]string{"/user\\.get/"}), "myuser.getter")).Should(BeFalse())
+		})
+
+		It("must match other items literally", func() {
+			Expect(shouldInclude(compilePatterns([]string{"users.get"}), "users.get")).Should(BeTrue())
+			Expect(shouldInclude(compilePatterns([]string{"users.get"}), "myusers.getter")).Should(BeFalse())
+			Expect(shouldInclude(compilePatterns([]string{"users.get"}), "xusers.getx")).Should(BeFalse())
+			Expect(shouldInclude(compilePatterns([]string{"users.get"}), "usersXget")).Should(BeFalse())
+			Expect(shouldInclude(compilePatterns([]string{".*\\.list"}), "user.list")).Should(BeFalse())
+		})
+	})
+
+})
+
+type codeError struct {
+	message string
+	code    int
+}
+
+func (e codeError) Error() string {
+	return e.message
+}
+
+func (e codeError) Code() int {
+	return e.code
+}
+
+// validationError is a structured error with name and code, like the moleculer errors.
+type validationError struct {
+	codeError
+}
+
+func (e validationError) Name() string {
+	return "ValidationError"
+}
+
+// selfSignedCert create a self signed certificate for localhost and return the cert and key file paths.
+func selfSignedCert(folder string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).Should(Succeed())
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"Gateway Test"}},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	Expect(err).Should(Succeed())
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	Expect(err).Should(Succeed())
+
+	certFile := filepath.Join(folder, "cert.pem")
+	keyFile := filepath.Join(folder, "key.pem")
+	Expect(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), 0600)).Should(Succeed())
+	Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)).Should(Succeed())
+	return certFile, keyFile
+}
+
+// actionContext return a context that answers every action call using the action func.
+func actionContext(action func(ctx moleculer.BrokerContext) interface{}) moleculer.Context {
+	delegates := test.DelegatesWithIdAndConfig("nodeID", moleculer.Config{})
+	delegates.ActionDelegate = func(ctx moleculer.BrokerContext, opts ...moleculer.Options) chan moleculer.Payload {
+		resultChan := make(chan moleculer.Payload, 1)
+		go func() {
+			resultChan <- payload.New(action(ctx))
+		}()
+		return resultChan
+	}
+	delegates.EmitEvent = func(ctx moleculer.BrokerContext) {}
+	return context.BrokerContext(delegates).(moleculer.Context)
+}
+
+// mockActionContext return a context that answers every action call with result
+// and a counter of how many calls were made.
+func mockActionContext(result interface{}) (moleculer.Context, *int) {
+	calls := 0
+	return actionContext(func(ctx moleculer.BrokerContext) interface{} {
+		calls++
+		return result
+	}), &calls
+}
+
+// echoActionContext return a context that answers every action call with the params received.
+func echoActionContext() moleculer.Context {
+	return actionContext(func(ctx moleculer.BrokerContext) interface{} {
+		return ctx.Payload()
+	})
+}
+
+type handlerSorter struct {
+	actionHandlers []*actionHandler
+}
+
+func (h handlerSorter) Len() int {
+	return len(h.actionHandlers)
 }
 
 func (h handlerSorter) Less(i, j int) bool {
@@ -412,3 +3572,53 @@ func (h handlerSorter) Swap(i, j int) {
 	h.actionHandlers[i] = jv
 	h.actionHandlers[j] = iv
 }
+
+// benchmarkActions is a list of actions used in the whitelist benchmarks.
+func benchmarkActions() []string {
+	actions := []string{}
+	for service := 0; service < 20; service++ {
+		for action := 0; action < 10; action++ {
+			actions = append(actions, fmt.Sprintf("service%d.action%d", service, action))
+		}
+	}
+	return actions
+}
+
+var benchmarkWhitelist = []string{"service1.*", "*.action2", "/service[3-5]\\.action\\d/"}
+
+// BenchmarkShouldIncludePerAction compile the whitelist for each action, like before the patterns were precompiled.
+func BenchmarkShouldIncludePerAction(b *testing.B) {
+	actions := benchmarkActions()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, action := range actions {
+			shouldInclude(compilePatterns(benchmarkWhitelist), action)
+		}
+	}
+}
+
+// BenchmarkShouldIncludePrecompiled compile the whitelist once per route, like filterActions.
+func BenchmarkShouldIncludePrecompiled(b *testing.B) {
+	actions := benchmarkActions()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		patterns := compilePatterns(benchmarkWhitelist)
+		for _, action := range actions {
+			shouldInclude(patterns, action)
+		}
+	}
+}
+
+// stubSerializer parse the body as the "name" param and serialize payloads as key=value.
+type stubSerializer struct {
+	parsed []string
+}
+
+func (s *stubSerializer) BytesToPayload(bts *[]byte) moleculer.Payload {
+	s.parsed = append(s.parsed, string(*bts))
+	return payload.Empty().Add("name", string(*bts))
+}
+
+func (s *stubSerializer) PayloadToBytes(p moleculer.Payload) []byte {
+	return []byte("name=" + p.Get("name").String())
+}
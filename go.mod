@@ -8,6 +8,10 @@ require (
 	github.com/moleculer-go/moleculer v0.2.1
 	github.com/onsi/ginkgo v1.8.0
 	github.com/onsi/gomega v1.5.0
+	github.com/rs/cors v1.6.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/tidwall/gjson v1.2.1
+	github.com/vmihailenco/msgpack v4.0.4+incompatible
+	golang.org/x/crypto v0.0.0-20181203042331-505ab145d0a9
+	golang.org/x/time v0.0.0-20190921001708-c4c64cad1fd0
 )
@@ -0,0 +1,621 @@
+package gateway
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moleculer-go/moleculer"
+	"github.com/moleculer-go/moleculer/payload"
+	"github.com/rs/cors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+)
+
+// stringsSetting return the setting value as a list of strings.
+func stringsSetting(settings map[string]interface{}, name string) []string {
+	switch value := settings[name].(type) {
+	case []string:
+		return value
+	case []interface{}:
+		result := []string{}
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				result = append(result, str)
+			}
+		}
+		return result
+	case string:
+		return []string{value}
+	}
+	return nil
+}
+
+// corsOptions create the cors.Options from the cors settings.
+func corsOptions(corsSettings map[string]interface{}) cors.Options {
+	allowCredentials, _ := corsSettings["allowCredentials"].(bool)
+	return cors.Options{
+		AllowedOrigins:   stringsSetting(corsSettings, "allowedOrigins"),
+		AllowedMethods:   stringsSetting(corsSettings, "allowedMethods"),
+		AllowedHeaders:   stringsSetting(corsSettings, "allowedHeaders"),
+		AllowCredentials: allowCredentials,
+	}
+}
+
+// corsMiddleware wraps the handler with CORS support when the cors settings are present.
+func corsMiddleware(settings map[string]interface{}, handler http.Handler) http.Handler {
+	corsSettings, enabled := settings["cors"].(map[string]interface{})
+	if !enabled {
+		return handler
+	}
+	return cors.New(corsOptions(corsSettings)).Handler(handler)
+}
+
+// routeCorsHandler is the handler of an action route with its own cors settings, which are used
+// instead of the global ones.
+type routeCorsHandler struct {
+	http.Handler
+}
+
+var defaultCompressionThreshold = 1024
+
+// compressionThreshold return the min body size to compress, when compression is enabled.
+func compressionThreshold(settings map[string]interface{}) (int, bool) {
+	switch compression := settings["compression"].(type) {
+	case bool:
+		return defaultCompressionThreshold, compression
+	case map[string]interface{}:
+		threshold, exists := compression["threshold"].(int)
+		if !exists {
+			threshold = defaultCompressionThreshold
+		}
+		return threshold, true
+	}
+	return 0, false
+}
+
+// gzipResponseWriter buffers the response until it reaches the threshold, then compresses it.
+// responses smaller than the threshold are sent uncompressed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	threshold  int
+	statusCode int
+	buffer     []byte
+	gzipWriter *gzip.Writer
+	// uncompressed is set for event streams, which are flushed frame by frame.
+	uncompressed bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *gzipResponseWriter) writeHeader() {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.statusCode)
+}
+
+func (w *gzipResponseWriter) Write(bytes []byte) (int, error) {
+	if w.uncompressed {
+		return w.ResponseWriter.Write(bytes)
+	}
+	if w.gzipWriter != nil {
+		return w.gzipWriter.Write(bytes)
+	}
+	w.buffer = append(w.buffer, bytes...)
+	if len(w.buffer) < w.threshold {
+		return len(bytes), nil
+	}
+	header := w.Header()
+	header.Set("Content-Encoding", "gzip")
+	header.Add("Vary", "Accept-Encoding")
+	header.Del("Content-Length")
+	w.writeHeader()
+	w.gzipWriter = gzip.NewWriter(w.ResponseWriter)
+	buffer := w.buffer
+	w.buffer = nil
+	if _, err := w.gzipWriter.Write(buffer); err != nil {
+		return 0, err
+	}
+	return len(bytes), nil
+}
+
+// Flush flush the compressed data written so far. Buffered data under the threshold is kept,
+// except for event streams (text/event-stream) which are sent uncompressed.
+func (w *gzipResponseWriter) Flush() {
+	if w.gzipWriter == nil && !w.uncompressed {
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+			return
+		}
+		w.uncompressed = true
+		w.writeHeader()
+		w.ResponseWriter.Write(w.buffer)
+		w.buffer = nil
+	}
+	if w.gzipWriter != nil {
+		w.gzipWriter.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close flush the compressed stream or the buffered uncompressed body.
+func (w *gzipResponseWriter) close() {
+	if w.uncompressed {
+		return
+	}
+	if w.gzipWriter != nil {
+		w.gzipWriter.Close()
+		return
+	}
+	if w.statusCode == 0 && len(w.buffer) == 0 {
+		return
+	}
+	w.writeHeader()
+	w.ResponseWriter.Write(w.buffer)
+}
+
+// compressionMiddleware compress responses with gzip when the client accepts it and compression is enabled.
+func compressionMiddleware(settings map[string]interface{}, handler http.Handler) http.Handler {
+	threshold, enabled := compressionThreshold(settings)
+	if !enabled {
+		return handler
+	}
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if !strings.Contains(request.Header.Get("Accept-Encoding"), "gzip") || isUpgrade(request) {
+			handler.ServeHTTP(response, request)
+			return
+		}
+		gzipResponse := &gzipResponseWriter{ResponseWriter: response, threshold: threshold}
+		defer gzipResponse.close()
+		handler.ServeHTTP(gzipResponse, request)
+	})
+}
+
+// isUpgrade check if the request asks for a protocol upgrade (e.g. websocket), which hijacks the
+// connection so the response can't be compressed.
+func isUpgrade(request *http.Request) bool {
+	return strings.Contains(strings.ToLower(request.Header.Get("Connection")), "upgrade")
+}
+
+// sendErrorLogger log the errors rendering the errorTemplates of the gateway errors.
+var sendErrorLogger = log.WithField("gateway", "sendError")
+
+// hasErrorEnvelope check if the errorEnvelope setting is on, true or a custom envelope func.
+func hasErrorEnvelope(settings map[string]interface{}) bool {
+	switch envelope := settings["errorEnvelope"].(type) {
+	case bool:
+		return envelope
+	case func(error, int) interface{}:
+		return true
+	}
+	return false
+}
+
+// sendError send a json error response with the status code, rendered with the errorTemplates and
+// errorEnvelope settings like the action errors. the default body is {"error": message}.
+func sendError(settings map[string]interface{}, response http.ResponseWriter, statusCode int, message string) {
+	err := statusError{message, statusCode}
+	handler := &actionHandler{settings: settings}
+	body, rendered := handler.renderErrorTemplate(sendErrorLogger, jsonSerializer, err, statusCode)
+	if !rendered && hasErrorEnvelope(settings) {
+		body = jsonSerializer.PayloadToBytes(handler.errorBody(err, statusCode))
+	} else if !rendered {
+		body = jsonSerializer.PayloadToBytes(payload.Empty().Add("error", message))
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(statusCode)
+	response.Write(body)
+}
+
+// sendJSON send the value serialized as JSON with the status code.
+func sendJSON(response http.ResponseWriter, statusCode int, value interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(statusCode)
+	response.Write(jsonSerializer.PayloadToBytes(payload.New(value)))
+}
+
+type userKey struct{}
+
+// userFromRequest return the user set by the authentication middlewares, or nil when absent.
+func userFromRequest(request *http.Request) moleculer.Payload {
+	user, _ := request.Context().Value(userKey{}).(moleculer.Payload)
+	return user
+}
+
+// withUser return a copy of the request carrying the authenticated user.
+func withUser(request *http.Request, user moleculer.Payload) *http.Request {
+	if user == nil {
+		user = payload.Empty()
+	}
+	return request.WithContext(context.WithValue(request.Context(), userKey{}, user))
+}
+
+// bearerToken return the token from the Authorization: Bearer header.
+func bearerToken(request *http.Request) (string, bool) {
+	header := request.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	return token, token != ""
+}
+
+// bearerMiddleware validate the Bearer token with the auth.bearer function from settings.
+// the payload returned by the function is sent to the action as meta "user", requests
+// with a missing or invalid token get a 401.
+func bearerMiddleware(settings map[string]interface{}, handler http.Handler) http.Handler {
+	auth, _ := settings["auth"].(map[string]interface{})
+	validate, enabled := auth["bearer"].(func(string) (moleculer.Payload, error))
+	if !enabled {
+		return handler
+	}
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		token, exists := bearerToken(request)
+		if !exists {
+			sendError(settings, response, http.StatusUnauthorized, "Missing Bearer token")
+			return
+		}
+		user, err := validate(token)
+		if err != nil {
+			sendError(settings, response, http.StatusUnauthorized, err.Error())
+			return
+		}
+		handler.ServeHTTP(response, withUser(request, user))
+	})
+}
+
+// basicCredentials return the map of usernames to bcrypt password hashes from the auth.basic setting.
+func basicCredentials(settings map[string]interface{}) (map[string]string, bool) {
+	auth, _ := settings["auth"].(map[string]interface{})
+	switch basic := auth["basic"].(type) {
+	case map[string]string:
+		return basic, true
+	case map[string]interface{}:
+		credentials := map[string]string{}
+		for username, hash := range basic {
+			if str, ok := hash.(string); ok {
+				credentials[username] = str
+			}
+		}
+		return credentials, true
+	}
+	return nil, false
+}
+
+// basicAuthMiddleware check the Authorization: Basic header against the bcrypt hashes from auth.basic.
+// the username is sent to the action as meta "user", failures get a 401 with WWW-Authenticate.
+// auth can be the service settings or a route, to protect only the actions of that route.
+// the 401 is rendered with the errorTemplates of the service settings.
+func basicAuthMiddleware(auth, settings map[string]interface{}, handler http.Handler) http.Handler {
+	credentials, enabled := basicCredentials(auth)
+	if !enabled {
+		return handler
+	}
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		username, password, exists := request.BasicAuth()
+		hash, known := credentials[username]
+		if !exists || !known || bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			response.Header().Set("WWW-Authenticate", `Basic realm="gateway"`)
+			sendError(settings, response, http.StatusUnauthorized, "Invalid credentials")
+			return
+		}
+		handler.ServeHTTP(response, withUser(request, payload.Empty().Add("username", username)))
+	})
+}
+
+// numberSetting return the setting value as float64, accepting int and float values.
+func numberSetting(settings map[string]interface{}, name string) (float64, bool) {
+	switch value := settings[name].(type) {
+	case int:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
+
+// clientIP return the IP of the client, from the last X-Forwarded-For entry when trustForwardedFor is on.
+// the last entry is the one appended by the trusted proxy, the ones before it are sent by the client
+// and can be forged.
+func clientIP(request *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		if forwarded := request.Header.Get("X-Forwarded-For"); forwarded != "" {
+			entries := strings.Split(forwarded, ",")
+			return strings.TrimSpace(entries[len(entries)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// clientInfo return the IP, scheme and host of the client request. when trustProxy is on they
+// come from the X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers set by the proxy.
+func clientInfo(request *http.Request, trustProxy bool) map[string]interface{} {
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	host := request.Host
+	if trustProxy {
+		if proto := firstHeaderValue(request, "X-Forwarded-Proto"); proto != "" {
+			scheme = proto
+		}
+		if forwardedHost := firstHeaderValue(request, "X-Forwarded-Host"); forwardedHost != "" {
+			host = forwardedHost
+		}
+	}
+	return map[string]interface{}{
+		"ip":     clientIP(request, trustProxy),
+		"scheme": scheme,
+		"host":   host,
+	}
+}
+
+// firstHeaderValue return the first entry of a comma separated header, e.g. added by a chain of proxies.
+func firstHeaderValue(request *http.Request, name string) string {
+	return strings.TrimSpace(strings.Split(request.Header.Get(name), ",")[0])
+}
+
+// rateLimiterIdleTimeout is the minimum time a client IP is kept without requests.
+var rateLimiterIdleTimeout = time.Minute
+
+// ipLimiter is the token bucket of a client IP with the time of its last request.
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// ipRateLimiter keeps one token bucket per client IP. the buckets idle for longer than
+// idleTimeout are removed, so the clients seen once don't stay in memory.
+type ipRateLimiter struct {
+	mutex       sync.Mutex
+	limiters    map[string]*ipLimiter
+	limit       rate.Limit
+	burst       int
+	idleTimeout time.Duration
+	lastSweep   time.Time
+}
+
+// newIPRateLimiter create the limiter. the idle timeout is at least the time to refill the burst,
+// so a removed bucket was full and a new one behaves the same. zero limit buckets never refill and
+// are not removed.
+func newIPRateLimiter(limit rate.Limit, burst int) *ipRateLimiter {
+	var idleTimeout time.Duration
+	if limit > 0 {
+		idleTimeout = time.Duration(float64(burst) / float64(limit) * float64(time.Second))
+		if idleTimeout < rateLimiterIdleTimeout {
+			idleTimeout = rateLimiterIdleTimeout
+		}
+	}
+	return &ipRateLimiter{
+		limiters:    map[string]*ipLimiter{},
+		limit:       limit,
+		burst:       burst,
+		idleTimeout: idleTimeout,
+		lastSweep:   time.Now(),
+	}
+}
+
+// limiter return the limiter for the ip, creating it on the first request.
+func (l *ipRateLimiter) limiter(ip string) *rate.Limiter {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	entry, exists := l.limiters[ip]
+	if !exists {
+		entry = &ipLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter
+}
+
+// sweep remove the limiters idle for longer than idleTimeout, at most once per idleTimeout.
+// must be called with the mutex held.
+func (l *ipRateLimiter) sweep(now time.Time) {
+	if l.idleTimeout <= 0 || now.Sub(l.lastSweep) < l.idleTimeout {
+		return
+	}
+	l.lastSweep = now
+	for ip, entry := range l.limiters {
+		if now.Sub(entry.lastSeen) >= l.idleTimeout {
+			delete(l.limiters, ip)
+		}
+	}
+}
+
+// retryAfter take a token for the ip and return zero when allowed, otherwise how long the client should wait.
+func (l *ipRateLimiter) retryAfter(ip string) time.Duration {
+	reservation := l.limiter(ip).Reserve()
+	if !reservation.OK() {
+		return time.Second
+	}
+	delay := reservation.Delay()
+	if delay > 0 {
+		reservation.Cancel()
+	}
+	return delay
+}
+
+// rateLimitMiddleware limit the requests per client IP using the rateLimit settings.
+// requests over the limit get a 429 with the Retry-After header.
+func rateLimitMiddleware(settings map[string]interface{}, handler http.Handler) http.Handler {
+	rateLimit, enabled := settings["rateLimit"].(map[string]interface{})
+	if !enabled {
+		return handler
+	}
+	requestsPerSecond, _ := numberSetting(rateLimit, "requestsPerSecond")
+	burst, exists := rateLimit["burst"].(int)
+	if !exists {
+		burst = int(math.Max(1, requestsPerSecond))
+	}
+	trustForwardedFor, _ := rateLimit["trustForwardedFor"].(bool)
+	trustProxy, _ := settings["trustProxy"].(bool)
+	trustForwardedFor = trustForwardedFor || trustProxy
+	limiter := newIPRateLimiter(rate.Limit(requestsPerSecond), burst)
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		wait := limiter.retryAfter(clientIP(request, trustForwardedFor))
+		if wait > 0 {
+			response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			sendError(settings, response, http.StatusTooManyRequests, "Too Many Requests")
+			return
+		}
+		handler.ServeHTTP(response, request)
+	})
+}
+
+// logLevelSetting return the log level named by the setting. nil, missing or invalid
+// values mean logging is off for that setting.
+func logLevelSetting(settings map[string]interface{}, name string) (log.Level, bool) {
+	value, exists := settings[name].(string)
+	if !exists {
+		return 0, false
+	}
+	level, err := log.ParseLevel(value)
+	if err != nil {
+		return 0, false
+	}
+	return level, true
+}
+
+// statusResponseWriter capture the status code and the size of the response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	size       int
+}
+
+func (w *statusResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusResponseWriter) Write(bytes []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	written, err := w.ResponseWriter.Write(bytes)
+	w.size += written
+	return written, err
+}
+
+// Flush pass the flush to the wrapped writer, so streamed responses keep working.
+func (w *statusResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack pass the hijack to the wrapped writer, so websocket upgrades keep working.
+func (w *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	w.statusCode = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// recoveryMiddleware recover from panics in the handler, log them and respond 500, so a failing
+// request does not take the server down. the response is left as is when it was already started.
+func recoveryMiddleware(settings map[string]interface{}, logger *log.Entry, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		statusResponse := &statusResponseWriter{ResponseWriter: response}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			logger.Error("Gateway recovered from panic - method: ", request.Method, " path: ", request.URL.Path, " error: ", err, "\n", string(debug.Stack()))
+			if statusResponse.statusCode == 0 {
+				sendError(settings, response, http.StatusInternalServerError, "Internal Server Error")
+			}
+		}()
+		handler.ServeHTTP(statusResponse, request)
+	})
+}
+
+// accessLogMiddleware log each request with method, path, status, duration and response size at the
+// accessLogLevel (info by default) when accessLog is on. 4xx responses are only logged with log4XXResponses.
+func accessLogMiddleware(settings map[string]interface{}, logger *log.Entry, handler http.Handler) http.Handler {
+	enabled, _ := settings["accessLog"].(bool)
+	if !enabled {
+		return handler
+	}
+	level, exists := logLevelSetting(settings, "accessLogLevel")
+	if !exists {
+		level = log.InfoLevel
+	}
+	log4XXResponses, _ := settings["log4XXResponses"].(bool)
+	trustProxy, _ := settings["trustProxy"].(bool)
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		statusResponse := &statusResponseWriter{ResponseWriter: response}
+		handler.ServeHTTP(statusResponse, request)
+		status := statusResponse.statusCode
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status >= 400 && status <= 499 && !log4XXResponses {
+			return
+		}
+		logger.WithFields(log.Fields{
+			"method":   request.Method,
+			"path":     request.URL.Path,
+			"ip":       clientIP(request, trustProxy),
+			"status":   status,
+			"duration": time.Since(start),
+			"size":     statusResponse.size,
+		}).Log(level, "Gateway access")
+	})
+}
+
+// metricsMiddleware emit the "$gateway.request" event with the path, method, status, duration
+// in milliseconds and response size in bytes of each request when metrics is on.
+func metricsMiddleware(settings map[string]interface{}, context moleculer.BrokerContext, handler http.Handler) http.Handler {
+	enabled, _ := settings["metrics"].(bool)
+	if !enabled {
+		return handler
+	}
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		statusResponse := &statusResponseWriter{ResponseWriter: response}
+		handler.ServeHTTP(statusResponse, request)
+		status := statusResponse.statusCode
+		if status == 0 {
+			status = http.StatusOK
+		}
+		context.Emit("$gateway.request", map[string]interface{}{
+			"path":     request.URL.Path,
+			"method":   request.Method,
+			"status":   status,
+			"duration": float64(time.Since(start)) / float64(time.Millisecond),
+			"size":     statusResponse.size,
+		})
+	})
+}
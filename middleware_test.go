@@ -0,0 +1,673 @@
+package gateway
+
+import (
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/moleculer-go/moleculer"
+	"github.com/moleculer-go/moleculer/context"
+	"github.com/moleculer-go/moleculer/payload"
+	"github.com/moleculer-go/moleculer/test"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/tidwall/gjson"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+)
+
+// okHandler is a plain handler used to check the behaviour of middlewares.
+var okHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+	response.WriteHeader(http.StatusOK)
+	response.Write([]byte("ok"))
+})
+
+var _ = Describe("Middlewares", func() {
+
+	Describe("corsMiddleware", func() {
+		settings := map[string]interface{}{
+			"cors": map[string]interface{}{
+				"allowedOrigins":   []string{"http://allowed.com"},
+				"allowedMethods":   []string{"GET", "POST"},
+				"allowedHeaders":   []string{"Content-Type"},
+				"allowCredentials": true,
+			},
+		}
+
+		It("should set Access-Control-Allow-Origin for a configured origin", func() {
+			handler := corsMiddleware(settings, okHandler)
+			request := httptest.NewRequest(http.MethodGet, "http://local/user/list", nil)
+			request.Header.Set("Origin", "http://allowed.com")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(http.StatusOK))
+			Expect(response.Header().Get("Access-Control-Allow-Origin")).Should(Equal("http://allowed.com"))
+			Expect(response.Header().Get("Access-Control-Allow-Credentials")).Should(Equal("true"))
+		})
+
+		It("should not set Access-Control-Allow-Origin for other origins", func() {
+			handler := corsMiddleware(settings, okHandler)
+			request := httptest.NewRequest(http.MethodGet, "http://local/user/list", nil)
+			request.Header.Set("Origin", "http://other.com")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Header().Get("Access-Control-Allow-Origin")).Should(Equal(""))
+		})
+
+		It("should keep CORS disabled when the cors settings are absent", func() {
+			handler := corsMiddleware(map[string]interface{}{}, okHandler)
+			request := httptest.NewRequest(http.MethodGet, "http://local/user/list", nil)
+			request.Header.Set("Origin", "http://allowed.com")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Header().Get("Access-Control-Allow-Origin")).Should(Equal(""))
+		})
+	})
+
+	Describe("compressionMiddleware", func() {
+		largeBody := strings.Repeat(`{"name":"John","lastName":"Snow"}`, 100)
+		bodyHandler := func(body string) http.Handler {
+			return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				response.Header().Set("Content-Type", "application/json")
+				response.WriteHeader(http.StatusCreated)
+				response.Write([]byte(body))
+			})
+		}
+		settings := map[string]interface{}{
+			"compression": map[string]interface{}{"threshold": 512},
+		}
+
+		It("should compress bodies larger than the threshold", func() {
+			handler := compressionMiddleware(settings, bodyHandler(largeBody))
+			request := httptest.NewRequest(http.MethodGet, "http://local/user/list", nil)
+			request.Header.Set("Accept-Encoding", "gzip, deflate")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(http.StatusCreated))
+			Expect(response.Header().Get("Content-Encoding")).Should(Equal("gzip"))
+			Expect(response.Body.Len()).Should(BeNumerically("<", len(largeBody)))
+
+			reader, err := gzip.NewReader(response.Body)
+			Expect(err).Should(Succeed())
+			bts, err := ioutil.ReadAll(reader)
+			Expect(err).Should(Succeed())
+			Expect(string(bts)).Should(Equal(largeBody))
+		})
+
+		It("should not compress bodies smaller than the threshold", func() {
+			handler := compressionMiddleware(settings, bodyHandler(`{"name":"John"}`))
+			request := httptest.NewRequest(http.MethodGet, "http://local/user/list", nil)
+			request.Header.Set("Accept-Encoding", "gzip")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(http.StatusCreated))
+			Expect(response.Header().Get("Content-Encoding")).Should(Equal(""))
+			Expect(response.Body.String()).Should(Equal(`{"name":"John"}`))
+		})
+
+		It("should not compress when the client does not accept gzip", func() {
+			handler := compressionMiddleware(settings, bodyHandler(largeBody))
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/user/list", nil))
+			Expect(response.Header().Get("Content-Encoding")).Should(Equal(""))
+			Expect(response.Body.String()).Should(Equal(largeBody))
+		})
+
+		It("should send event streams uncompressed as they are flushed", func() {
+			var flushed string
+			handler := compressionMiddleware(settings, http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				response.Header().Set("Content-Type", "text/event-stream")
+				response.WriteHeader(http.StatusOK)
+				response.(http.Flusher).Flush()
+				response.Write([]byte("data: 1\n\n"))
+				response.(http.Flusher).Flush()
+				flushed = response.(*gzipResponseWriter).ResponseWriter.(*httptest.ResponseRecorder).Body.String()
+			}))
+			request := httptest.NewRequest(http.MethodGet, "http://local/notifications", nil)
+			request.Header.Set("Accept-Encoding", "gzip")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(flushed).Should(Equal("data: 1\n\n"))
+			Expect(response.Header().Get("Content-Encoding")).Should(Equal(""))
+			Expect(response.Body.String()).Should(Equal("data: 1\n\n"))
+		})
+
+		It("should not compress websocket upgrades", func() {
+			handler := compressionMiddleware(settings, http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				conn, err := wsUpgrader.Upgrade(response, request, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				conn.WriteMessage(websocket.TextMessage, []byte(largeBody))
+			}))
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			header := http.Header{"Accept-Encoding": []string{"gzip, deflate, br"}}
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+			Expect(err).Should(Succeed())
+			defer conn.Close()
+			_, message, err := conn.ReadMessage()
+			Expect(err).Should(Succeed())
+			Expect(string(message)).Should(Equal(largeBody))
+		})
+
+		It("should not compress when compression is not enabled", func() {
+			handler := compressionMiddleware(map[string]interface{}{}, bodyHandler(largeBody))
+			request := httptest.NewRequest(http.MethodGet, "http://local/user/list", nil)
+			request.Header.Set("Accept-Encoding", "gzip")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Header().Get("Content-Encoding")).Should(Equal(""))
+		})
+	})
+})
+
+var _ = Describe("Authentication middlewares", func() {
+
+	Describe("bearerMiddleware", func() {
+		settings := map[string]interface{}{
+			"auth": map[string]interface{}{
+				"bearer": func(token string) (moleculer.Payload, error) {
+					if token != "valid-token" {
+						return nil, errors.New("Invalid token")
+					}
+					return payload.Empty().Add("name", "John"), nil
+				},
+			},
+		}
+
+		It("should pass the user from a valid token to the action meta", func() {
+			var meta moleculer.Payload
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				meta = ctx.Meta()
+				return "allowed"
+			})
+			handler := bearerMiddleware(settings, &actionHandler{action: "users.list", context: ctx})
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+			request.Header.Set("Authorization", "Bearer valid-token")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(http.StatusOK))
+			Expect(response.Body.String()).Should(Equal("allowed"))
+			Expect(meta.Get("user").Get("name").String()).Should(Equal("John"))
+		})
+
+		It("should respond 401 with the validation error for an invalid token", func() {
+			handler := bearerMiddleware(settings, okHandler)
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+			request.Header.Set("Authorization", "Bearer wrong-token")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(http.StatusUnauthorized))
+			Expect(gjson.Get(response.Body.String(), "error").String()).Should(Equal("Invalid token"))
+		})
+
+		It("should respond 401 when the token is missing", func() {
+			handler := bearerMiddleware(settings, okHandler)
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(http.StatusUnauthorized))
+
+			request = httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+			request.Header.Set("Authorization", "Basic am9objpzbm93")
+			response = httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(http.StatusUnauthorized))
+		})
+
+		It("should not require a token when auth.bearer is absent", func() {
+			handler := bearerMiddleware(map[string]interface{}{}, okHandler)
+			request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("basicAuthMiddleware", func() {
+		hash, _ := bcrypt.GenerateFromPassword([]byte("snow"), bcrypt.MinCost)
+		settings := map[string]interface{}{
+			"auth": map[string]interface{}{
+				"basic": map[string]string{
+					"john": string(hash),
+				},
+			},
+		}
+
+		It("should pass the username to the action meta with correct credentials", func() {
+			var meta moleculer.Payload
+			ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+				meta = ctx.Meta()
+				return "allowed"
+			})
+			handler := basicAuthMiddleware(settings, settings, &actionHandler{action: "admin.stats", context: ctx})
+			request := httptest.NewRequest(http.MethodGet, "http://local/admin/stats", nil)
+			request.SetBasicAuth("john", "snow")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(http.StatusOK))
+			Expect(response.Body.String()).Should(Equal("allowed"))
+			Expect(meta.Get("user").Get("username").String()).Should(Equal("john"))
+		})
+
+		It("should respond 401 with WWW-Authenticate for a wrong password or unknown user", func() {
+			handler := basicAuthMiddleware(settings, settings, okHandler)
+			for _, user := range [][]string{{"john", "wrong"}, {"arya", "snow"}} {
+				request := httptest.NewRequest(http.MethodGet, "http://local/admin/stats", nil)
+				request.SetBasicAuth(user[0], user[1])
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, request)
+				Expect(response.Code).Should(Equal(http.StatusUnauthorized))
+				Expect(response.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="gateway"`))
+			}
+		})
+
+		It("should respond 401 with WWW-Authenticate when the header is absent", func() {
+			handler := basicAuthMiddleware(settings, settings, okHandler)
+			request := httptest.NewRequest(http.MethodGet, "http://local/admin/stats", nil)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(http.StatusUnauthorized))
+			Expect(response.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="gateway"`))
+		})
+
+		It("should protect only the actions of a route with auth.basic", func() {
+			route := map[string]interface{}{
+				"path": "/admin",
+				"auth": settings["auth"],
+			}
+			router := mux.NewRouter()
+			protected := &actionHandler{action: "admin.stats", routePath: "/admin", route: route, context: echoActionContext()}
+			open := &actionHandler{action: "users.list", routePath: "/", route: map[string]interface{}{"path": "/"}, context: echoActionContext()}
+			router.Handle(protected.pattern(), basicAuthMiddleware(protected.route, nil, protected))
+			router.Handle(open.pattern(), basicAuthMiddleware(open.route, nil, open))
+
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/admin/admin/stats", nil))
+			Expect(response.Code).Should(Equal(http.StatusUnauthorized))
+
+			response = httptest.NewRecorder()
+			router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+			Expect(response.Code).Should(Equal(http.StatusOK))
+		})
+	})
+})
+
+var _ = Describe("rateLimitMiddleware", func() {
+	settings := map[string]interface{}{
+		"rateLimit": map[string]interface{}{
+			"requestsPerSecond": 1,
+			"burst":             3,
+		},
+	}
+	requestFrom := func(remoteAddr string) *http.Request {
+		request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+		request.RemoteAddr = remoteAddr
+		return request
+	}
+
+	It("should allow a burst and respond 429 with Retry-After once it is exceeded", func() {
+		handler := rateLimitMiddleware(settings, okHandler)
+		for i := 0; i < 3; i++ {
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, requestFrom("10.0.0.1:5000"))
+			Expect(response.Code).Should(Equal(http.StatusOK))
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, requestFrom("10.0.0.1:5001"))
+		Expect(response.Code).Should(Equal(http.StatusTooManyRequests))
+		Expect(response.Header().Get("Retry-After")).Should(Equal("1"))
+	})
+
+	It("should keep a separate limit for each client IP", func() {
+		handler := rateLimitMiddleware(settings, okHandler)
+		for i := 0; i < 4; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), requestFrom("10.0.0.1:5000"))
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, requestFrom("10.0.0.2:5000"))
+		Expect(response.Code).Should(Equal(http.StatusOK))
+	})
+
+	It("should limit concurrent bursts to the burst size", func() {
+		handler := rateLimitMiddleware(settings, okHandler)
+		codes := make(chan int, 20)
+		var group sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			group.Add(1)
+			go func() {
+				defer group.Done()
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, requestFrom("10.0.0.3:5000"))
+				codes <- response.Code
+			}()
+		}
+		group.Wait()
+		close(codes)
+		allowed := 0
+		for code := range codes {
+			if code == http.StatusOK {
+				allowed++
+			}
+		}
+		Expect(allowed).Should(Equal(3))
+	})
+
+	It("should remove the limiters of the idle client IPs", func() {
+		limiter := newIPRateLimiter(rate.Limit(1000), 1)
+		Expect(limiter.idleTimeout).Should(Equal(rateLimiterIdleTimeout))
+		limiter.idleTimeout = 20 * time.Millisecond
+		limiter.limiter("10.0.0.1")
+		limiter.limiter("10.0.0.2")
+		Expect(limiter.limiters).Should(HaveLen(2))
+
+		time.Sleep(30 * time.Millisecond)
+		limiter.limiter("10.0.0.3")
+		Expect(limiter.limiters).Should(HaveLen(1))
+		Expect(limiter.limiters).Should(HaveKey("10.0.0.3"))
+
+		Expect(newIPRateLimiter(rate.Limit(1), 120).idleTimeout).Should(Equal(2 * time.Minute))
+	})
+
+	It("should use the X-Forwarded-For client only when trustForwardedFor is on", func() {
+		trusted := map[string]interface{}{
+			"rateLimit": map[string]interface{}{
+				"requestsPerSecond": 1,
+				"burst":             1,
+				"trustForwardedFor": true,
+			},
+		}
+		handler := rateLimitMiddleware(trusted, okHandler)
+		for _, client := range []string{"1.1.1.1", "2.2.2.2"} {
+			request := requestFrom("10.0.0.9:5000")
+			request.Header.Set("X-Forwarded-For", client)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(http.StatusOK))
+		}
+		Expect(clientIP(requestFrom("10.0.0.9:5000"), false)).Should(Equal("10.0.0.9"))
+	})
+
+	It("should not let the client bypass the limit with forged X-Forwarded-For entries", func() {
+		trusted := map[string]interface{}{
+			"rateLimit": map[string]interface{}{
+				"requestsPerSecond": 1,
+				"burst":             1,
+				"trustForwardedFor": true,
+			},
+		}
+		handler := rateLimitMiddleware(trusted, okHandler)
+		codes := []int{}
+		for _, forged := range []string{"6.6.6.1", "6.6.6.2", "6.6.6.3"} {
+			request := requestFrom("10.0.0.9:5000")
+			request.Header.Set("X-Forwarded-For", forged+", 1.1.1.1")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			codes = append(codes, response.Code)
+		}
+		Expect(codes).Should(Equal([]int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}))
+	})
+
+	It("should not limit when the rateLimit settings are absent", func() {
+		handler := rateLimitMiddleware(map[string]interface{}{}, okHandler)
+		for i := 0; i < 10; i++ {
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, requestFrom("10.0.0.1:5000"))
+			Expect(response.Code).Should(Equal(http.StatusOK))
+		}
+	})
+})
+
+var _ = Describe("accessLogMiddleware", func() {
+	statusHandler := func(statusCode int) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			response.WriteHeader(statusCode)
+			response.Write([]byte("body"))
+		})
+	}
+
+	It("should log the method, path, status, duration and size of the request", func() {
+		logger, hook := logtest.NewNullLogger()
+		handler := accessLogMiddleware(map[string]interface{}{"accessLog": true}, log.NewEntry(logger), okHandler)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://local/users/create", nil))
+
+		Expect(hook.Entries).Should(HaveLen(1))
+		entry := hook.LastEntry()
+		Expect(entry.Level).Should(Equal(log.InfoLevel))
+		Expect(entry.Data["method"]).Should(Equal("POST"))
+		Expect(entry.Data["path"]).Should(Equal("/users/create"))
+		Expect(entry.Data["status"]).Should(Equal(http.StatusOK))
+		Expect(entry.Data["size"]).Should(Equal(2))
+		Expect(entry.Data["duration"]).ShouldNot(BeNil())
+	})
+
+	It("should log the size of the compressed response", func() {
+		logger, hook := logtest.NewNullLogger()
+		largeBody := strings.Repeat(`{"name":"John"}`, 200)
+		compressed := compressionMiddleware(map[string]interface{}{"compression": true}, http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			response.Write([]byte(largeBody))
+		}))
+		handler := accessLogMiddleware(map[string]interface{}{"accessLog": true}, log.NewEntry(logger), compressed)
+		request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+		request.Header.Set("Accept-Encoding", "gzip")
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		Expect(response.Header().Get("Content-Encoding")).Should(Equal("gzip"))
+		Expect(hook.LastEntry().Data["size"]).Should(Equal(response.Body.Len()))
+	})
+
+	It("should log at the accessLogLevel", func() {
+		logger, hook := logtest.NewNullLogger()
+		logger.SetLevel(log.DebugLevel)
+		settings := map[string]interface{}{"accessLog": true, "accessLogLevel": "debug"}
+		handler := accessLogMiddleware(settings, log.NewEntry(logger), okHandler)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+		Expect(hook.LastEntry().Level).Should(Equal(log.DebugLevel))
+	})
+
+	It("should log 4xx responses only when log4XXResponses is on", func() {
+		logger, hook := logtest.NewNullLogger()
+		handler := accessLogMiddleware(map[string]interface{}{"accessLog": true}, log.NewEntry(logger), statusHandler(http.StatusNotFound))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://local/missing", nil))
+		Expect(hook.Entries).Should(BeEmpty())
+
+		settings := map[string]interface{}{"accessLog": true, "log4XXResponses": true}
+		handler = accessLogMiddleware(settings, log.NewEntry(logger), statusHandler(http.StatusNotFound))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://local/missing", nil))
+		Expect(hook.LastEntry().Data["status"]).Should(Equal(http.StatusNotFound))
+
+		hook.Reset()
+		handler = accessLogMiddleware(map[string]interface{}{"accessLog": true}, log.NewEntry(logger), statusHandler(http.StatusInternalServerError))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://local/broken", nil))
+		Expect(hook.LastEntry().Data["status"]).Should(Equal(http.StatusInternalServerError))
+	})
+
+	It("should not log when accessLog is off", func() {
+		logger, hook := logtest.NewNullLogger()
+		handler := accessLogMiddleware(map[string]interface{}{}, log.NewEntry(logger), okHandler)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+		Expect(hook.Entries).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("clientInfo", func() {
+	forwardedRequest := func() *http.Request {
+		request := httptest.NewRequest(http.MethodGet, "http://internal:8080/users/list", nil)
+		request.RemoteAddr = "10.0.0.9:5000"
+		request.Header.Set("X-Forwarded-For", "203.0.113.7")
+		request.Header.Set("X-Forwarded-Proto", "https")
+		request.Header.Set("X-Forwarded-Host", "api.example.com")
+		return request
+	}
+
+	It("should use the X-Forwarded-* headers when trustProxy is on", func() {
+		Expect(clientInfo(forwardedRequest(), true)).Should(Equal(map[string]interface{}{
+			"ip":     "203.0.113.7",
+			"scheme": "https",
+			"host":   "api.example.com",
+		}))
+	})
+
+	It("should take the client ip from the entry appended by the proxy", func() {
+		request := forwardedRequest()
+		request.Header.Set("X-Forwarded-For", "6.6.6.6, 203.0.113.7")
+		Expect(clientInfo(request, true)["ip"]).Should(Equal("203.0.113.7"))
+	})
+
+	It("should ignore the X-Forwarded-* headers when trustProxy is off", func() {
+		Expect(clientInfo(forwardedRequest(), false)).Should(Equal(map[string]interface{}{
+			"ip":     "10.0.0.9",
+			"scheme": "http",
+			"host":   "internal:8080",
+		}))
+	})
+
+	It("should pass the client info to the action meta", func() {
+		var meta moleculer.Payload
+		ctx := actionContext(func(ctx moleculer.BrokerContext) interface{} {
+			meta = ctx.Meta()
+			return "result"
+		})
+		handler := actionHandler{action: "users.list", settings: map[string]interface{}{"trustProxy": true}, context: ctx}
+		request := forwardedRequest()
+		request.Header.Set("X-Forwarded-For", "6.6.6.6, 203.0.113.7")
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+		Expect(meta.Get("client").Get("ip").String()).Should(Equal("203.0.113.7"))
+		Expect(meta.Get("client").Get("scheme").String()).Should(Equal("https"))
+
+		handler = actionHandler{action: "users.list", settings: map[string]interface{}{}, context: ctx}
+		handler.ServeHTTP(httptest.NewRecorder(), forwardedRequest())
+		Expect(meta.Get("client").Get("ip").String()).Should(Equal("10.0.0.9"))
+		Expect(meta.Get("client").Get("host").String()).Should(Equal("internal:8080"))
+	})
+
+	It("should rate limit by the forwarded client when trustProxy is on", func() {
+		settings := map[string]interface{}{
+			"trustProxy": true,
+			"rateLimit":  map[string]interface{}{"requestsPerSecond": 1, "burst": 1},
+		}
+		handler := rateLimitMiddleware(settings, okHandler)
+		for _, client := range []string{"1.1.1.1", "2.2.2.2"} {
+			request := forwardedRequest()
+			request.Header.Set("X-Forwarded-For", client)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			Expect(response.Code).Should(Equal(http.StatusOK))
+		}
+	})
+})
+
+var _ = Describe("recoveryMiddleware", func() {
+	It("should respond 500 with a JSON error when the handler panics", func() {
+		logger, hook := logtest.NewNullLogger()
+		panicHandler := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			panic("boom")
+		})
+		server := httptest.NewServer(recoveryMiddleware(nil, log.NewEntry(logger), panicHandler))
+		defer server.Close()
+
+		response, err := http.Get(server.URL + "/users/list")
+		Expect(err).Should(Succeed())
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		Expect(response.StatusCode).Should(Equal(http.StatusInternalServerError))
+		Expect(string(body)).Should(Equal(`{"error":"Internal Server Error"}`))
+		Expect(hook.LastEntry().Level).Should(Equal(log.ErrorLevel))
+		Expect(hook.LastEntry().Message).Should(ContainSubstring("boom"))
+
+		response, err = http.Get(server.URL + "/users/list")
+		Expect(err).Should(Succeed())
+		response.Body.Close()
+		Expect(response.StatusCode).Should(Equal(http.StatusInternalServerError))
+	})
+
+	It("should let the handler hijack the connection", func() {
+		handler := recoveryMiddleware(nil, log.WithField("unit", "test"), http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			conn, buffer, err := response.(http.Hijacker).Hijack()
+			Expect(err).Should(Succeed())
+			buffer.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\n\r\nhijacked")
+			buffer.Flush()
+			conn.Close()
+		}))
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		response, err := http.Get(server.URL)
+		Expect(err).Should(Succeed())
+		body, _ := ioutil.ReadAll(response.Body)
+		Expect(string(body)).Should(Equal("hijacked"))
+	})
+
+	It("should keep the response of a handler that panics after writing it", func() {
+		handler := recoveryMiddleware(nil, log.WithField("unit", "test"), http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			response.WriteHeader(http.StatusAccepted)
+			panic("late boom")
+		}))
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+		Expect(response.Code).Should(Equal(http.StatusAccepted))
+		Expect(response.Body.String()).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("metricsMiddleware", func() {
+	delegates := test.DelegatesWithIdAndConfig("nodeID", moleculer.Config{})
+	emitted := make(chan moleculer.BrokerContext, 10)
+	delegates.EmitEvent = func(ctx moleculer.BrokerContext) {
+		emitted <- ctx
+	}
+	bkrContext := context.BrokerContext(delegates)
+
+	It("should emit $gateway.request with the path, method, status and duration", func() {
+		slowHandler := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			time.Sleep(10 * time.Millisecond)
+			response.WriteHeader(http.StatusCreated)
+		})
+		handler := metricsMiddleware(map[string]interface{}{"metrics": true}, bkrContext, slowHandler)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://local/users/create", nil))
+
+		var event moleculer.BrokerContext
+		Eventually(emitted).Should(Receive(&event))
+		Expect(event.EventName()).Should(Equal("$gateway.request"))
+		Expect(event.Payload().Get("path").String()).Should(Equal("/users/create"))
+		Expect(event.Payload().Get("method").String()).Should(Equal("POST"))
+		Expect(event.Payload().Get("status").Int()).Should(Equal(http.StatusCreated))
+		Expect(event.Payload().Get("duration").Float()).Should(BeNumerically(">=", 10))
+	})
+
+	It("should emit the size of the written bytes, after compression", func() {
+		largeBody := strings.Repeat(`{"name":"John"}`, 200)
+		compressed := compressionMiddleware(map[string]interface{}{"compression": true}, http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			response.Write([]byte(largeBody))
+		}))
+		handler := metricsMiddleware(map[string]interface{}{"metrics": true}, bkrContext, compressed)
+		request := httptest.NewRequest(http.MethodGet, "http://local/users/list", nil)
+		request.Header.Set("Accept-Encoding", "gzip")
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		var event moleculer.BrokerContext
+		Eventually(emitted).Should(Receive(&event))
+		Expect(response.Header().Get("Content-Encoding")).Should(Equal("gzip"))
+		Expect(event.Payload().Get("size").Int()).Should(Equal(response.Body.Len()))
+		Expect(event.Payload().Get("size").Int()).Should(BeNumerically("<", len(largeBody)))
+	})
+
+	It("should not emit events when metrics is off", func() {
+		handler := metricsMiddleware(map[string]interface{}{}, bkrContext, okHandler)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://local/users/list", nil))
+		Consistently(emitted, 50*time.Millisecond).ShouldNot(Receive())
+	})
+})
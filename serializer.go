@@ -0,0 +1,173 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/moleculer-go/moleculer"
+	"github.com/moleculer-go/moleculer/payload"
+	"github.com/vmihailenco/msgpack"
+)
+
+// payloadSerializer convert payloads to the bytes sent over HTTP and back.
+type payloadSerializer interface {
+	BytesToPayload(*[]byte) moleculer.Payload
+	PayloadToBytes(moleculer.Payload) []byte
+}
+
+// msgpackSerializer serialize payloads using MessagePack.
+type msgpackSerializer struct{}
+
+var msgpackPayloadSerializer = msgpackSerializer{}
+
+// plainValue convert payloads (including nested ones) into plain maps, slices and values.
+func plainValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case moleculer.Payload:
+		if value.IsError() {
+			return map[string]interface{}{"error": value.Error().Error()}
+		}
+		if value.IsMap() {
+			return plainValue(value.RawMap())
+		}
+		if value.IsArray() {
+			return plainValue(value.ValueArray())
+		}
+		return plainValue(value.Value())
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			result[key] = plainValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for index, item := range value {
+			result[index] = plainValue(item)
+		}
+		return result
+	}
+	return value
+}
+
+func (serializer msgpackSerializer) PayloadToBytes(p moleculer.Payload) []byte {
+	bts, err := msgpack.Marshal(plainValue(p))
+	if err != nil {
+		bts, _ = msgpack.Marshal(map[string]interface{}{"error": err.Error()})
+	}
+	return bts
+}
+
+func (serializer msgpackSerializer) BytesToPayload(bts *[]byte) moleculer.Payload {
+	var value interface{}
+	if err := msgpack.Unmarshal(*bts, &value); err != nil {
+		return payload.Error("Error trying to parse msgpack body. Error: ", err.Error())
+	}
+	return payload.New(value)
+}
+
+// xmlSerializer serialize payloads as XML, with the value inside a <response> element.
+// map keys become elements and array items become <item> elements.
+type xmlSerializer struct{}
+
+var xmlPayloadSerializer = xmlSerializer{}
+
+func (serializer xmlSerializer) PayloadToBytes(p moleculer.Payload) []byte {
+	buffer := bytes.NewBufferString(xml.Header)
+	writeXMLElement(buffer, "response", plainValue(p))
+	return buffer.Bytes()
+}
+
+// BytesToPayload is not supported, XML is only used for responses.
+func (serializer xmlSerializer) BytesToPayload(bts *[]byte) moleculer.Payload {
+	return payload.Error("XML request bodies are not supported")
+}
+
+// xmlName convert the key into a valid XML element name, replacing the invalid characters with _.
+func xmlName(key string) string {
+	name := []rune(key)
+	for index, char := range name {
+		if !unicode.IsLetter(char) && !unicode.IsDigit(char) && char != '_' && char != '-' && char != '.' {
+			name[index] = '_'
+		}
+	}
+	if len(name) == 0 || !(unicode.IsLetter(name[0]) || name[0] == '_') {
+		return "_" + string(name)
+	}
+	return string(name)
+}
+
+// writeXMLElement write the value as an element with the name. maps and slices are written as nested elements.
+func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}) {
+	name = xmlName(name)
+	if value == nil {
+		fmt.Fprintf(buffer, "<%s/>", name)
+		return
+	}
+	fmt.Fprintf(buffer, "<%s>", name)
+	reflected := reflect.ValueOf(value)
+	switch {
+	case reflected.Kind() == reflect.Map && reflected.Type().Key().Kind() == reflect.String:
+		keys := make([]string, 0, reflected.Len())
+		for _, key := range reflected.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			writeXMLElement(buffer, key, plainValue(reflected.MapIndex(reflect.ValueOf(key).Convert(reflected.Type().Key())).Interface()))
+		}
+	case (reflected.Kind() == reflect.Slice || reflected.Kind() == reflect.Array) && reflected.Type().Elem().Kind() != reflect.Uint8:
+		for index := 0; index < reflected.Len(); index++ {
+			writeXMLElement(buffer, "item", plainValue(reflected.Index(index).Interface()))
+		}
+	default:
+		xml.EscapeText(buffer, []byte(fmt.Sprint(value)))
+	}
+	fmt.Fprintf(buffer, "</%s>", name)
+}
+
+// isXML check if the preferred media type of the Accept header is XML. only the first media type
+// is considered, since browsers list application/xml after text/html and should keep getting JSON.
+func isXML(accept string) bool {
+	mediaType := strings.TrimSpace(strings.Split(strings.Split(accept, ",")[0], ";")[0])
+	return mediaType == "application/xml" || mediaType == "text/xml"
+}
+
+// isMsgpack check if the media type (from Accept or Content-Type) is MessagePack.
+func isMsgpack(mediaType string) bool {
+	return strings.Contains(mediaType, "application/msgpack") || strings.Contains(mediaType, "application/x-msgpack")
+}
+
+// settingsSerializer return the serializer from the "serializer" setting, defaulting to JSON.
+func settingsSerializer(settings map[string]interface{}) payloadSerializer {
+	if custom, exists := settings["serializer"].(payloadSerializer); exists {
+		return custom
+	}
+	return jsonSerializer
+}
+
+// serializerForAccept select the response serializer and content type from the Accept header (msgpack or XML).
+// defaults to the serializer from settings (JSON).
+func serializerForAccept(accept string, settings map[string]interface{}) (payloadSerializer, string) {
+	if isMsgpack(accept) {
+		return msgpackPayloadSerializer, "application/msgpack"
+	}
+	if isXML(accept) {
+		return xmlPayloadSerializer, "application/xml"
+	}
+	return settingsSerializer(settings), "application/json"
+}
+
+// serializerForContentType select the serializer used to parse the request body from the Content-Type header.
+// defaults to the serializer from settings (JSON).
+func serializerForContentType(contentType string, settings map[string]interface{}) payloadSerializer {
+	if isMsgpack(contentType) {
+		return msgpackPayloadSerializer
+	}
+	return settingsSerializer(settings)
+}